@@ -0,0 +1,154 @@
+//go:build linux
+// +build linux
+
+// Package cgrouptest provides a fake cgroup.FileSystem to test code using
+// package cgroup without privileges.
+package cgrouptest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// FS is a cgroup.FileSystem under a temporary directory standing for /. Like
+// cgroupfs, a directory made by Mkdir gets the control files its parent has,
+// writing to a missing file fails, and removing a directory removes its
+// control files but fails with EBUSY if it has child cgroups or processes.
+// Anything else behaves as the os functions do.
+type FS struct {
+	Root string
+}
+
+// New returns a FS having the files, removed when the test ends.
+func New(t testing.TB, files map[string]string) *FS {
+	fs := &FS{Root: t.TempDir()}
+	for path, content := range files {
+		fs.Write(t, path, content)
+	}
+	return fs
+}
+
+func (fs *FS) path(path string) string {
+	return filepath.Join(fs.Root, path)
+}
+
+// Write creates the file with the content along with missing directories.
+func (fs *FS) Write(t testing.TB, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(fs.path(path)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fs.path(path), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Read returns the content of the file.
+func (fs *FS) Read(t testing.TB, path string) string {
+	t.Helper()
+	buf, err := ioutil.ReadFile(fs.path(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+// Exists tells whether the path exists.
+func (fs *FS) Exists(path string) bool {
+	_, err := os.Stat(fs.path(path))
+	return err == nil
+}
+
+func (fs *FS) Mkdir(path string, mode os.FileMode) error {
+	if err := os.Mkdir(fs.path(path), mode); err != nil {
+		return err
+	}
+	parent := filepath.Dir(path)
+	files, err := ioutil.ReadDir(fs.path(parent))
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		var content []byte
+		if fi.Name() != "cgroup.procs" && fi.Name() != "tasks" {
+			if content, err = ioutil.ReadFile(fs.path(filepath.Join(parent, fi.Name()))); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(fs.path(filepath.Join(path, fi.Name())), content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FS) Chmod(path string, mode os.FileMode) error { return os.Chmod(fs.path(path), mode) }
+func (fs *FS) Chown(path string, uid, gid int) error     { return os.Chown(fs.path(path), uid, gid) }
+
+func (fs *FS) Remove(path string) error {
+	fi, err := os.Stat(fs.path(path))
+	if err != nil || !fi.IsDir() {
+		return os.Remove(fs.path(path))
+	}
+	files, err := ioutil.ReadDir(fs.path(path))
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			return &os.PathError{Op: "remove", Path: path, Err: syscall.EBUSY}
+		}
+		if fi.Name() == "cgroup.procs" {
+			if buf, _ := ioutil.ReadFile(fs.path(filepath.Join(path, fi.Name()))); strings.TrimSpace(string(buf)) != "" {
+				return &os.PathError{Op: "remove", Path: path, Err: syscall.EBUSY}
+			}
+		}
+	}
+	for _, fi := range files {
+		if err := os.Remove(fs.path(filepath.Join(path, fi.Name()))); err != nil {
+			return err
+		}
+	}
+	return os.Remove(fs.path(path))
+}
+
+func (fs *FS) Stat(path string) (os.FileInfo, error)      { return os.Stat(fs.path(path)) }
+func (fs *FS) ReadDir(path string) ([]os.FileInfo, error) { return ioutil.ReadDir(fs.path(path)) }
+func (fs *FS) ReadFile(path string) ([]byte, error)       { return ioutil.ReadFile(fs.path(path)) }
+
+func (fs *FS) WriteFile(path string, data []byte) error {
+	f, err := os.OpenFile(fs.path(path), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (fs *FS) Access(path string, mode uint32) error {
+	return unix.Faccessat(unix.AT_FDCWD, fs.path(path), mode, unix.AT_EACCESS)
+}
+
+func (fs *FS) EvalSymlinks(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(fs.path(path))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(fs.Root, resolved)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join("/", rel), nil
+}
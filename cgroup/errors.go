@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ErrSubsysNotMounted tells that the subsystem isn't available on the system.
+type ErrSubsysNotMounted struct {
+	Subsys string
+	// The cgroup version forced by Version, 0 otherwise
+	Version int
+}
+
+func (e *ErrSubsysNotMounted) Error() string {
+	if e.Version != 0 {
+		return fmt.Sprintf("subsystem '%s' is not available in the cgroup v%d hierarchy", e.Subsys, e.Version)
+	}
+	return fmt.Sprintf("subsystem '%s' is not mounted", e.Subsys)
+}
+
+// ErrUnknownParam tells that the subsystem has no such parameter.
+type ErrUnknownParam struct {
+	Subsys, Param string
+	Err           error
+}
+
+func (e *ErrUnknownParam) Error() string {
+	return fmt.Sprintf("unknown parameter %s.%s for subsystem %s", e.Subsys, e.Param, e.Subsys)
+}
+
+func (e *ErrUnknownParam) Unwrap() error { return e.Err }
+
+// ErrHierarchyExists tells that the cgroup to create already exists.
+type ErrHierarchyExists struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrHierarchyExists) Error() string {
+	return fmt.Sprintf("cgroup '%s' already exists", e.Path)
+}
+
+func (e *ErrHierarchyExists) Unwrap() error { return e.Err }
+
+// ErrParamWrite tells that the kernel has rejected the parameter. Err is the
+// errno, e.g. syscall.EINVAL for a malformed value.
+type ErrParamWrite struct {
+	Subsys, Param, Value string
+	Err                  error
+}
+
+func (e *ErrParamWrite) Error() string {
+	return fmt.Sprintf("writing %s.%s=%s failed: %s", e.Subsys, e.Param, strings.TrimRight(e.Value, "\n"), e.Err)
+}
+
+func (e *ErrParamWrite) Unwrap() error { return e.Err }
+
+// ErrInsufficientPrivileges tells that cgroups can't be created under Path.
+type ErrInsufficientPrivileges struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrInsufficientPrivileges) Error() string {
+	if errors.Is(e.Err, syscall.EROFS) {
+		return fmt.Sprintf("can't create cgroup under %s: cgroupfs is mounted read-only, this usually means you're in an unprivileged container (try cgroup v2 delegation or run on the host)", e.Path)
+	}
+	if os.Geteuid() == 0 {
+		// Root is denied only when the cgroupfs belongs to the host
+		// rather than the user namespace we're in
+		return fmt.Sprintf("can't create cgroup under %s even as root: cgroupfs appears undelegated, this usually means you're in an unprivileged container (try cgroup v2 delegation or run on the host)", e.Path)
+	}
+	return fmt.Sprintf("insufficient privileges to create cgroup under %s (try running as root)", e.Path)
+}
+
+func (e *ErrInsufficientPrivileges) Unwrap() error { return e.Err }
+
+// ErrCanceled tells that Setup has been canceled by Spec.Cancel.
+var ErrCanceled = errors.New("setup of cgroup hierarchy canceled")
+
+// ErrParentNotFound tells that the parent cgroup doesn't exist.
+type ErrParentNotFound struct {
+	Parent, MountPoint, Subsys string
+}
+
+func (e *ErrParentNotFound) Error() string {
+	return fmt.Sprintf("parent cgroup '%s' does not exist under %s for subsystem %s", e.Parent, e.MountPoint, e.Subsys)
+}
+
+// ErrEmptyCpuset tells that a process can't join the cpuset cgroup because it
+// has no cpus or mems to run on.
+type ErrEmptyCpuset struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrEmptyCpuset) Error() string {
+	return fmt.Sprintf("can't attach pid to cpuset cgroup %s: cpuset.cpus/mems must be set", e.Path)
+}
+
+func (e *ErrEmptyCpuset) Unwrap() error { return e.Err }
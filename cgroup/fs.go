@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileSystem is what the package accesses cgroupfs and /proc through.
+type FileSystem interface {
+	Mkdir(path string, mode os.FileMode) error
+	Chmod(path string, mode os.FileMode) error
+	Chown(path string, uid, gid int) error
+	Remove(path string) error
+	Stat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	ReadFile(path string) ([]byte, error)
+	// WriteFile writes to the existing file, e.g. a control file
+	WriteFile(path string, data []byte) error
+	// Access checks permissions of the path with the effective uid/gid
+	Access(path string, mode uint32) error
+	EvalSymlinks(path string) (string, error)
+}
+
+// FS is the FileSystem used by the package. It can be replaced before Init,
+// or Reset to switch to another one, e.g. with a fake one to run it without
+// privileges in tests.
+var FS FileSystem = OSFileSystem{}
+
+// OSFileSystem is the FileSystem of the operating system.
+type OSFileSystem struct{}
+
+func (OSFileSystem) Mkdir(path string, mode os.FileMode) error { return os.Mkdir(path, mode) }
+func (OSFileSystem) Chmod(path string, mode os.FileMode) error { return os.Chmod(path, mode) }
+func (OSFileSystem) Chown(path string, uid, gid int) error     { return os.Chown(path, uid, gid) }
+func (OSFileSystem) Remove(path string) error                  { return os.Remove(path) }
+func (OSFileSystem) Stat(path string) (os.FileInfo, error)     { return os.Stat(path) }
+func (OSFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(path)
+}
+func (OSFileSystem) ReadFile(path string) ([]byte, error) { return ioutil.ReadFile(path) }
+func (OSFileSystem) WriteFile(path string, data []byte) error {
+	return ioutil.WriteFile(path, data, 0)
+}
+func (OSFileSystem) Access(path string, mode uint32) error {
+	return unix.Faccessat(unix.AT_FDCWD, path, mode, unix.AT_EACCESS)
+}
+func (OSFileSystem) EvalSymlinks(path string) (string, error) { return filepath.EvalSymlinks(path) }
+
+// walk calls fn for the path and everything under it, parents first, like
+// filepath.Walk does but through FS. It stops at the first error.
+func walk(path string, fn func(path string, fi os.FileInfo) error) error {
+	fi, err := FS.Stat(path)
+	if err != nil {
+		return err
+	}
+	return walkInfo(path, fi, fn)
+}
+
+func walkInfo(path string, fi os.FileInfo, fn func(path string, fi os.FileInfo) error) error {
+	if err := fn(path, fi); err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	children, err := FS.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := walkInfo(filepath.Join(path, child.Name()), child, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
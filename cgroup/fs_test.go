@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+package cgroup
+
+import (
+	"testing"
+
+	"github.com/kawamuray/cgrun/cgroup/cgrouptest"
+)
+
+// A v1 system having cpu and memory mounted separately
+var v1Files = map[string]string{
+	"/proc/cgroups": "#subsys_name\thierarchy\tnum_cgroups\tenabled\n" +
+		"cpu\t2\t1\t1\n" +
+		"memory\t3\t1\t1\n",
+	"/proc/mounts": "sysfs /sys sysfs rw 0 0\n" +
+		"cgroup /sys/fs/cgroup/cpu cgroup rw,nosuid,cpu 0 0\n" +
+		"cgroup /sys/fs/cgroup/memory cgroup rw,nosuid,memory 0 0\n",
+	"/sys/fs/cgroup/cpu/cgroup.procs":             "1\n",
+	"/sys/fs/cgroup/cpu/tasks":                    "1\n",
+	"/sys/fs/cgroup/cpu/notify_on_release":        "0\n",
+	"/sys/fs/cgroup/cpu/cpu.shares":               "1024\n",
+	"/sys/fs/cgroup/memory/cgroup.procs":          "1\n",
+	"/sys/fs/cgroup/memory/tasks":                 "1\n",
+	"/sys/fs/cgroup/memory/notify_on_release":     "0\n",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes": "9223372036854771712\n",
+}
+
+// useFakeFS replaces FS with a fake one having the files until the test
+// ends, forgetting what Init has found on the previous one.
+func useFakeFS(t *testing.T, files map[string]string) *cgrouptest.FS {
+	fs := cgrouptest.New(t, files)
+	FS = fs
+	Reset()
+	t.Cleanup(func() {
+		FS = OSFileSystem{}
+		Reset()
+	})
+	return fs
+}
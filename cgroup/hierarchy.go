@@ -0,0 +1,1301 @@
+//go:build linux
+// +build linux
+
+// Package cgroup creates volatile cgroup hierarchies, puts processes into
+// them and removes them afterwards. It's the core of cgrun and can be used
+// by other programs as well.
+package cgroup
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Debugf is called with what's being done, nothing is printed by default.
+var Debugf = func(format string, args ...interface{}) {}
+
+// Warnf is called with problems which don't make the operation fail.
+var Warnf = func(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+var mandatoryParameters = map[string][]string{
+	"cpuset": []string{
+		"cpus",
+		"mems",
+	},
+}
+
+// Parameters each write to which adds a rule instead of replacing the value
+var appendParams = map[string]bool{
+	"devices.allow": true,
+	"devices.deny":  true,
+	"io.max":        true, // A line for each device
+}
+
+// IsAppendParam tells whether the parameter is a list of rules, each written
+// separately. Rules are separated by newlines in Spec.Params.
+func IsAppendParam(subsys, param string) bool {
+	return appendParams[subsys+"."+param]
+}
+
+// Owner is the user who gets the ownership of the hierarchy. -1 leaves the
+// uid or gid as is.
+type Owner struct {
+	Uid, Gid int
+}
+
+// DefaultDirMode is the permission of cgroups created when Spec.DirMode is 0.
+const DefaultDirMode os.FileMode = 0750
+
+// Spec describes the hierarchy to create.
+type Spec struct {
+	// Parent hierarchy that should be inherited. If empty, the cgroup of the
+	// calling process is used for each subsystem.
+	Parent string
+	// If not 0 and Parent is empty, the cgroup of the process is used as the
+	// parent for each subsystem instead of the calling process's one. On v2
+	// it has to be the root, as others having processes in them can't enable
+	// controllers for children (the no internal process rule)
+	ParentPid int
+	// Name of the hierarchy under Parent, generated if empty. Missing
+	// intermediate cgroups in the name like team/job1 are created.
+	Name string
+	// If the hierarchy of Name exists, try Name-1, Name-2 and so on until
+	// a free one is found instead of failing
+	SuffixOnConflict bool
+	// Parameters in v1 style, which are translated on v2 systems. Rules of
+	// parameters like devices.allow are separated by newlines
+	Params map[string]map[string]string
+	// Chown the hierarchy to the user if not nil
+	Owner *Owner
+	// Permission of cgroups created, regardless of umask
+	DirMode os.FileMode
+	// If not nil, what would be done is printed to it instead of doing it
+	DryRun io.Writer
+	// Skip parameters the kernel doesn't have with a warning instead of
+	// failing, e.g. cpu.cfs_quota_us without CONFIG_CFS_BANDWIDTH
+	IgnoreUnsupported bool
+	// Don't copy cpuset.cpus and cpuset.mems from the parent, they must be
+	// given in Params instead
+	NoInherit bool
+	// Raise cpu.rt_runtime_us of ancestors which don't have enough RT
+	// bandwidth for the hierarchy, restored by Cleanup
+	BorrowRT bool
+	// If closed, Setup stops as soon as possible and fails with ErrCanceled
+	// after undoing what it has done, e.g. on a signal
+	Cancel <-chan struct{}
+	// Refuse to create the hierarchy if its parent directory already has
+	// this many child cgroups, unlimited if 0
+	MaxSiblings int
+	// Set notify_on_release of v1 hierarchies so that the release agent is
+	// run once it becomes empty. Otherwise it's cleared even if the parent
+	// has it, as the hierarchy is removed by Cleanup anyway
+	NotifyOnRelease bool
+	// Disable controllers Setup has enabled in cgroup.subtree_control of
+	// ancestors on v2 again by Cleanup, e.g. for a scratch hierarchy which
+	// shouldn't change anything. Others created under them meanwhile lose
+	// the controllers as well
+	RestoreControllers bool
+}
+
+// Hierarchy is a cgroup hierarchy created by Setup.
+type Hierarchy struct {
+	// Name of the hierarchy relative to the parent
+	Name string
+	// Parameters written to the hierarchy, translated ones on v2 systems
+	Params map[string]map[string]string
+
+	parents   map[string]string // Parent path for each subsystem
+	dirMode   os.FileMode
+	dryRun    io.Writer
+	noInherit bool
+	notify    bool
+	borrowRT  bool
+	borrowed  []rtBorrow
+	restore   bool // Spec.RestoreControllers
+
+	// What setup has done so far, undone by rollback if it fails
+	cancel        <-chan struct{}
+	created       map[string]bool // Directories of the hierarchy
+	intermediates []string        // Intermediate cgroups created, parents first
+	enabled       []string        // cgroup.subtree_control we've written +SUBSYS to
+
+	cleanupOnce sync.Once
+	cleanupErr  error
+}
+
+// Path returns the directory of the hierarchy for the subsystem.
+func (h *Hierarchy) Path(subsys string) string {
+	return filepath.Join(subsysMountPoints[subsys], h.parents[subsys], h.Name)
+}
+
+// Paths returns the directories of the hierarchy, one for each distinct
+// mount point.
+func (h *Hierarchy) Paths() ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	for subsys, _ := range h.Params {
+		mountPoint, ok := subsysMountPoints[subsys]
+		if !ok || mountPoint == "" {
+			return nil, &ErrSubsysNotMounted{Subsys: subsys, Version: Version}
+		}
+		path := filepath.Join(mountPoint, h.parents[subsys], h.Name)
+		if !seen[path] {
+			paths = append(paths, path)
+			seen[path] = true
+		}
+	}
+	return paths, nil
+}
+
+// TasksFiles returns the files to which pids are written to join the
+// hierarchy.
+func (h *Hierarchy) TasksFiles() ([]string, error) {
+	paths, err := h.Paths()
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, path := range paths {
+		files = append(files, filepath.Join(path, TasksFileName()))
+	}
+	return files, nil
+}
+
+// Attach moves the process into the hierarchy.
+func (h *Hierarchy) Attach(pid int) error {
+	tasksFiles, err := h.TasksFiles()
+	if err != nil {
+		return err
+	}
+	for _, tasksFile := range tasksFiles {
+		Debugf("attaching pid %d to %s", pid, tasksFile)
+		if err := WritePid(tasksFile, pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WritePid moves the process into the cgroup of the tasks file, one of ones
+// returned by TasksFiles.
+func WritePid(tasksFile string, pid int) error {
+	err := FS.WriteFile(tasksFile, []byte(strconv.Itoa(pid)))
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EINVAL) {
+		// All the kernel tells for a cpuset cgroup without cpus or mems,
+		// which is a common mistake. Older kernels use EINVAL
+		dir := filepath.Dir(tasksFile)
+		if _, statErr := FS.Stat(filepath.Join(dir, "cpuset.cpus")); statErr == nil {
+			return &ErrEmptyCpuset{Path: dir, Err: err}
+		}
+	}
+	return err
+}
+
+// MoveBack moves the process out of the hierarchy into the cgroups, usually
+// ones returned by ProcessCgroups before it's attached. The hierarchy is
+// thawed first as frozen tasks can't leave the cgroup.
+func (h *Hierarchy) MoveBack(pid int, cgroups map[string]string) error {
+	h.thaw()
+	seen := make(map[string]bool)
+	for subsys, _ := range h.Params {
+		path, ok := cgroups[subsys]
+		if !ok {
+			continue
+		}
+		tasksFile := filepath.Join(subsysMountPoints[subsys], path, TasksFileName())
+		if seen[tasksFile] {
+			continue
+		}
+		seen[tasksFile] = true
+		Debugf("moving pid %d back to %s", pid, tasksFile)
+		if err := WritePid(tasksFile, pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidName tells whether the name can be used as a hierarchy name. Nested
+// name like team/batch/job1 is allowed.
+func ValidName(name string) bool {
+	for _, comp := range strings.Split(name, "/") {
+		if comp == "" || comp == "." || comp == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// GenerateName returns a random name which is unlikely to be used by others.
+func GenerateName() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		// Still unique enough unless another one is made in the same nanosecond
+		hash := md5.New()
+		fmt.Fprintf(hash, "%d %d", time.Now().UnixNano(), os.Getpid())
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Times to retry with another generated name if it's used by others
+const nameAttempts = 3
+
+// Setup creates the hierarchy and writes parameters to it. Nothing is left
+// if it fails.
+func (s *Spec) Setup() (*Hierarchy, error) {
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	if s.Name != "" {
+		if !ValidName(s.Name) {
+			return nil, fmt.Errorf("invalid cgroup name: '%s'", s.Name)
+		}
+		name := s.Name
+		for i := 1; ; i++ {
+			h, err := s.setup(name)
+			var existErr *ErrHierarchyExists
+			if errors.As(err, &existErr) && s.SuffixOnConflict {
+				Debugf("%s, retrying with a suffix", err)
+				name = fmt.Sprintf("%s-%d", s.Name, i)
+				continue
+			}
+			return h, err
+		}
+	}
+	for i := 1; ; i++ {
+		h, err := s.setup(GenerateName())
+		var existErr *ErrHierarchyExists
+		if errors.As(err, &existErr) && i < nameAttempts {
+			Debugf("%s, retrying with another name", err)
+			continue
+		}
+		return h, err
+	}
+}
+
+func (s *Spec) setup(name string) (_ *Hierarchy, err error) {
+	params := s.Params
+	if cgroupV2 {
+		if params, err = translateV2Params(params); err != nil {
+			return nil, err
+		}
+	}
+	var subsyses []string
+	for subsys, _ := range params {
+		subsyses = append(subsyses, subsys)
+	}
+	parents, err := resolveParents(s.Parent, s.ParentPid, subsyses)
+	if err != nil {
+		return nil, err
+	}
+	h := &Hierarchy{
+		Name:      name,
+		Params:    params,
+		parents:   parents,
+		dirMode:   s.DirMode,
+		dryRun:    s.DryRun,
+		noInherit: s.NoInherit,
+		notify:    s.NotifyOnRelease,
+		borrowRT:  s.BorrowRT,
+		cancel:    s.Cancel,
+		restore:   s.RestoreControllers,
+	}
+	if h.dirMode == 0 {
+		h.dirMode = DefaultDirMode
+	}
+
+	h.created = make(map[string]bool)
+	defer func() {
+		if err != nil {
+			h.rollback()
+		}
+	}()
+
+	for subsys, _ := range params {
+		mountPoint, ok := subsysMountPoints[subsys]
+		if !ok || mountPoint == "" {
+			return nil, &ErrSubsysNotMounted{Subsys: subsys, Version: Version}
+		}
+		if _, err := FS.Stat(h.ancestorPaths(subsys)[0]); os.IsNotExist(err) {
+			return nil, &ErrParentNotFound{Parent: h.parents[subsys], MountPoint: mountPoint, Subsys: subsys}
+		}
+		if h.dryRun == nil {
+			if err := h.checkWritable(subsys); err != nil {
+				return nil, err
+			}
+		}
+		if s.MaxSiblings > 0 {
+			if err := checkSiblings(filepath.Dir(h.Path(subsys)), s.MaxSiblings); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := h.checkParams(); err != nil {
+		return nil, err
+	}
+
+	for subsys, _ := range params {
+		if err := h.canceled(); err != nil {
+			return nil, err
+		}
+		if err := h.makeIntermediateDirs(subsys); err != nil {
+			return nil, err
+		}
+	}
+
+	if cgroupV2 {
+		if err := h.enableControllers(); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := params["cpu"]; ok && h.borrowRT && !cgroupV2 {
+		if err := h.borrowRTBandwidth(); err != nil {
+			return nil, err
+		}
+	}
+
+	planned := make(map[string]bool) // For dry-run
+	unsupported := make(map[string]map[string]bool)
+	for subsys, values := range params {
+		if err := h.canceled(); err != nil {
+			return nil, err
+		}
+		hirPath := h.Path(subsys)
+		if h.dryRun != nil {
+			if !planned[hirPath] {
+				fmt.Fprintf(h.dryRun, "create %s\n", hirPath)
+				planned[hirPath] = true
+			}
+			continue
+		}
+		// In v2 every subsystem shares the same directory, as do co-mounted
+		// ones like cpu,cpuacct in v1
+		if !h.created[hirPath] {
+			if err := h.mkdir(hirPath); err != nil {
+				if os.IsExist(err) {
+					return nil, &ErrHierarchyExists{Path: hirPath, Err: err}
+				}
+				return nil, err
+			}
+			h.created[hirPath] = true
+			Debugf("created %s", hirPath)
+			if !cgroupV2 {
+				if err := h.setNotifyOnRelease(hirPath); err != nil {
+					return nil, err
+				}
+			}
+			if s.Owner != nil {
+				err := walk(hirPath, func(path string, _ os.FileInfo) error {
+					return FS.Chown(path, s.Owner.Uid, s.Owner.Gid)
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		// Catch typos before writing anything so that we won't leave the
+		// hierarchy half configured
+		for param, _ := range values {
+			path := filepath.Join(hirPath, subsys+"."+param)
+			if _, err := FS.Stat(path); err != nil {
+				if os.IsNotExist(err) && s.IgnoreUnsupported {
+					Warnf("ignoring %s.%s which is not supported by the kernel", subsys, param)
+					if unsupported[subsys] == nil {
+						unsupported[subsys] = make(map[string]bool)
+					}
+					unsupported[subsys][param] = true
+					continue
+				}
+				if os.IsNotExist(err) {
+					return nil, &ErrUnknownParam{Subsys: subsys, Param: param, Err: err}
+				}
+				return nil, err
+			}
+		}
+	}
+	if len(unsupported) > 0 {
+		// Not to modify the given Spec
+		params = make(map[string]map[string]string)
+		for subsys, values := range h.Params {
+			params[subsys] = make(map[string]string)
+			for param, value := range values {
+				if !unsupported[subsys][param] {
+					params[subsys][param] = value
+				}
+			}
+		}
+		h.Params = params
+	}
+
+	if err := h.writeParams(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// canceled returns ErrCanceled if Spec.Cancel has been closed.
+func (h *Hierarchy) canceled() error {
+	select {
+	case <-h.cancel:
+		return ErrCanceled
+	default:
+		return nil
+	}
+}
+
+// rollback undoes what setup has done so far. Only directories we created
+// are removed, existing cgroups must be left as is.
+func (h *Hierarchy) rollback() {
+	for hirPath, _ := range h.created {
+		removeHierarchyPath(hirPath)
+	}
+	for i := len(h.intermediates) - 1; i >= 0; i-- {
+		// Another one might have created its cgroup under it meanwhile
+		if err := FS.Remove(h.intermediates[i]); err != nil && !os.IsNotExist(err) {
+			Debugf("leaving %s: %s", h.intermediates[i], err)
+		} else {
+			Debugf("removed %s", h.intermediates[i])
+		}
+	}
+	h.disableControllers()
+	h.returnRTBandwidth()
+}
+
+// disableControllers disables controllers enableControllers has enabled,
+// bottom-up.
+func (h *Hierarchy) disableControllers() {
+	for i := len(h.enabled) - 1; i >= 0; i-- {
+		// Fails if others have started using it meanwhile, which is fine
+		path, subsys := filepath.Split(h.enabled[i])
+		path = filepath.Join(path, "cgroup.subtree_control")
+		if err := h.writeControlFile(path, []byte("-"+subsys)); err != nil && !os.IsNotExist(err) {
+			Debugf("leaving %s enabled in %s: %s", subsys, path, err)
+		}
+	}
+	h.enabled = nil
+}
+
+// writeParams writes parameters of the hierarchy, along with mandatory ones
+// copied from the parent.
+func (h *Hierarchy) writeParams() error {
+	for subsys, values := range h.Params {
+		if err := h.canceled(); err != nil {
+			return err
+		}
+		hirPath := h.Path(subsys)
+		if err := h.inheritMandatoryParams(subsys, hirPath, values); err != nil {
+			return err
+		}
+
+		for _, w := range paramWrites(subsys, values) {
+			if err := h.writeParam(hirPath, subsys, w.param, w.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reapply writes parameters of the hierarchy again, e.g. after cpuset.cpus of
+// the parent has changed, which are copied from it again as well.
+func (h *Hierarchy) Reapply() error {
+	return h.writeParams()
+}
+
+// resolveParents decides the parent path of each subsystem. An empty parent
+// means the cgroup which the process of pid, or this process if 0, is in.
+func resolveParents(parent string, pid int, subsyses []string) (map[string]string, error) {
+	parents := make(map[string]string)
+	if parent == "" && pid == 0 && cgroupV2 {
+		// The cgroup we're in can't enable controllers for its children
+		// since it has processes in it (the no internal process rule)
+		parent = "/"
+	}
+	if parent != "" {
+		for _, subsys := range subsyses {
+			parents[subsys] = parent
+		}
+		return parents, nil
+	}
+
+	var current map[string]string
+	var err error
+	if pid != 0 {
+		if current, err = ProcessCgroups(pid); err != nil {
+			return nil, fmt.Errorf("can't find out the cgroup of pid %d: %s", pid, err)
+		}
+	} else if current, err = ProcessCgroups(os.Getpid()); err != nil {
+		return nil, fmt.Errorf("can't find out the current cgroup: %s", err)
+	}
+	for _, subsys := range subsyses {
+		if parents[subsys] = current[subsys]; parents[subsys] == "" {
+			parents[subsys] = "/"
+		}
+		if cgroupV2 && parents[subsys] != "/" {
+			return nil, fmt.Errorf("cgroup '%s' of pid %d can't be the parent on cgroup v2 as it has processes, which can't have child cgroups using controllers",
+				parents[subsys], pid)
+		}
+	}
+	return parents, nil
+}
+
+// enableControllers enables controllers in cgroup.subtree_control of every
+// ancestor below the parent so that the hierarchy we create gets their
+// interface files.
+func (h *Hierarchy) enableControllers() error {
+	for subsys, _ := range h.Params {
+		for _, dirPath := range h.ancestorPaths(subsys) {
+			buf, err := FS.ReadFile(filepath.Join(dirPath, "cgroup.controllers"))
+			if err != nil {
+				if h.dryRun != nil && os.IsNotExist(err) {
+					continue // An intermediate which would be created
+				}
+				return err
+			}
+			if !hasField(string(buf), subsys) {
+				return fmt.Errorf("subsystem '%s' is not available under '%s'", subsys, dirPath)
+			}
+			path := filepath.Join(dirPath, "cgroup.subtree_control")
+			if buf, err := FS.ReadFile(path); err == nil && hasField(string(buf), subsys) {
+				continue // Not to disable it on rollback
+			}
+			if err := h.writeControlFile(path, []byte("+"+subsys)); err != nil {
+				return err
+			}
+			h.enabled = append(h.enabled, filepath.Join(dirPath, subsys))
+		}
+	}
+	return nil
+}
+
+// hasField tells whether the space separated list like cgroup.controllers
+// has the name.
+func hasField(list, name string) bool {
+	for _, field := range strings.Fields(list) {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ancestorPaths returns paths from the parent hierarchy down to the direct
+// parent of the hierarchy.
+func (h *Hierarchy) ancestorPaths(subsys string) []string {
+	dirPath := filepath.Join(subsysMountPoints[subsys], h.parents[subsys])
+	paths := []string{dirPath}
+	rel, err := filepath.Rel(dirPath, filepath.Dir(h.Path(subsys)))
+	if err != nil || rel == "." {
+		return paths
+	}
+	for _, name := range strings.Split(rel, "/") {
+		dirPath = filepath.Join(dirPath, name)
+		paths = append(paths, dirPath)
+	}
+	return paths
+}
+
+// checkWritable makes sure that we can create the hierarchy under the
+// nearest existing ancestor before doing anything.
+func (h *Hierarchy) checkWritable(subsys string) error {
+	paths := h.ancestorPaths(subsys)
+	for i := len(paths) - 1; i >= 0; i-- {
+		if _, err := FS.Stat(paths[i]); err != nil {
+			continue
+		}
+		if err := FS.Access(paths[i], unix.W_OK|unix.X_OK); err != nil {
+			return &ErrInsufficientPrivileges{Path: paths[i], Err: err}
+		}
+		return nil
+	}
+	return nil
+}
+
+// setNotifyOnRelease sets notify_on_release of the v1 hierarchy, which is
+// copied from the parent on creation, if it's not the one wanted.
+func (h *Hierarchy) setNotifyOnRelease(hirPath string) error {
+	path := filepath.Join(hirPath, "notify_on_release")
+	buf, err := FS.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	value := "0"
+	if h.notify {
+		value = "1"
+	}
+	if strings.TrimSpace(string(buf)) == value {
+		return nil
+	}
+	if err := h.writeControlFile(path, []byte(value)); err != nil {
+		return fmt.Errorf("writing notify_on_release=%s to %s failed: %s", value, hirPath, err)
+	}
+	return nil
+}
+
+// checkSiblings fails if the directory has max or more child cgroups. A
+// missing one is an intermediate to be created, which has none.
+func checkSiblings(dirPath string, max int) error {
+	children, err := FS.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	count := 0
+	for _, child := range children {
+		if child.IsDir() {
+			count++
+		}
+	}
+	if count >= max {
+		return fmt.Errorf("'%s' already has %d child cgroups, can't create more than %d", dirPath, count, max)
+	}
+	return nil
+}
+
+// makeIntermediateDirs creates missing intermediate cgroups between the
+// parent hierarchy and the hierarchy. Existing ones are left as is.
+func (h *Hierarchy) makeIntermediateDirs(subsys string) error {
+	for _, dirPath := range h.ancestorPaths(subsys)[1:] {
+		if err := h.canceled(); err != nil {
+			return err
+		}
+		if h.dryRun != nil {
+			if _, err := FS.Stat(dirPath); os.IsNotExist(err) {
+				fmt.Fprintf(h.dryRun, "create %s\n", dirPath)
+			}
+			continue
+		}
+		if err := h.mkdir(dirPath); err != nil {
+			if os.IsExist(err) {
+				continue
+			}
+			return err
+		}
+		h.intermediates = append(h.intermediates, dirPath)
+		Debugf("created %s", dirPath)
+		if h.noInherit && !cgroupV2 {
+			// The hierarchy's ones have to be a subset of them
+			for _, param := range mandatoryParameters[subsys] {
+				if err := h.writeParam(dirPath, subsys, param, h.Params[subsys][param]); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := h.inheritMandatoryParams(subsys, dirPath, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdir creates the cgroup with the permission as is, which is masked by
+// umask otherwise.
+func (h *Hierarchy) mkdir(path string) error {
+	if err := FS.Mkdir(path, h.dirMode); err != nil {
+		// checkWritable can't tell it e.g. for a read-only bind mount in a
+		// container
+		if errors.Is(err, syscall.EROFS) || os.IsPermission(err) {
+			return &ErrInsufficientPrivileges{Path: filepath.Dir(path), Err: err}
+		}
+		return err
+	}
+	return FS.Chmod(path, h.dirMode)
+}
+
+// readInheritedParam reads the parameter from the nearest ancestor which has
+// it set. Parents might have it empty, e.g. cpuset.cpus of a cpuset cgroup
+// nobody has configured, which makes the hierarchy unusable if copied.
+// Intermediates which don't exist yet, when checking parameters before
+// creating them or in dry-run, are skipped as well.
+func (h *Hierarchy) readInheritedParam(subsys, param, hirPath string) ([]byte, error) {
+	mountPoint := subsysMountPoints[subsys]
+	emptyDir := ""
+	for dir := filepath.Dir(hirPath); ; dir = filepath.Dir(dir) {
+		buf, err := FS.ReadFile(filepath.Join(dir, subsys+"."+param))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		value := strings.TrimSpace(string(buf))
+		if err == nil && value == "" && emptyDir == "" {
+			emptyDir = dir
+		}
+		if (err == nil && value != "") || len(dir) <= len(mountPoint) {
+			if emptyDir != "" && value != "" {
+				// A cpuset can't have cpus/mems which its parent doesn't have
+				return nil, fmt.Errorf("%s.%s of '%s' is empty, it has to be set first (nearest ancestor '%s' has '%s')",
+					subsys, param, emptyDir, dir, value)
+			}
+			return buf, nil
+		}
+	}
+}
+
+// checkParams rejects well-known conflicting parameters before touching
+// anything, for which the kernel would just tell EINVAL in the middle of
+// writing them.
+func (h *Hierarchy) checkParams() error {
+	if h.noInherit && !cgroupV2 {
+		for subsys, _ := range h.Params {
+			for _, param := range mandatoryParameters[subsys] {
+				if _, ok := h.Params[subsys][param]; !ok {
+					return fmt.Errorf("%s.%s must be given as it's not inherited from the parent", subsys, param)
+				}
+			}
+		}
+	}
+
+	if memory, ok := h.Params["memory"]; ok && !cgroupV2 {
+		if memsw, ok := memory["memsw.limit_in_bytes"]; ok && memsw != "-1" {
+			limit, ok := memory["limit_in_bytes"]
+			if !ok || limit == "-1" {
+				return fmt.Errorf("memory.memsw.limit_in_bytes requires memory.limit_in_bytes not larger than it")
+			}
+			l, lerr := strconv.ParseInt(limit, 10, 64)
+			m, merr := strconv.ParseInt(memsw, 10, 64)
+			if lerr == nil && merr == nil && l > m {
+				return fmt.Errorf("memory.limit_in_bytes=%s is larger than memory.memsw.limit_in_bytes=%s", limit, memsw)
+			}
+		}
+	}
+
+	if cpu, ok := h.Params["cpu"]; ok && !cgroupV2 {
+		if period, ok := cpu["cfs_period_us"]; ok {
+			if n, err := strconv.ParseInt(period, 10, 64); err == nil && (n < 1000 || n > 1000000) {
+				return fmt.Errorf("cpu.cfs_period_us=%s is out of range, must be between 1000 and 1000000", period)
+			}
+		}
+		if quota, ok := cpu["cfs_quota_us"]; ok {
+			if n, err := strconv.ParseInt(quota, 10, 64); err == nil && n != -1 && n < 1000 {
+				return fmt.Errorf("cpu.cfs_quota_us=%s is too small, must be at least 1000 or -1", quota)
+			}
+		}
+		if runtime, period := h.rtBandwidth(); runtime > 0 && !h.borrowRT {
+			// The kernel tells just EINVAL for it
+			parent := filepath.Dir(h.Path("cpu"))
+			if !hasRTBandwidth(parent, runtime, period) {
+				return fmt.Errorf("parent cgroup '%s' has no RT bandwidth to allocate for cpu.rt_runtime_us=%d", parent, runtime)
+			}
+		}
+	}
+
+	if cpuset, ok := h.Params["cpuset"]; ok && !cgroupV2 && subsysMountPoints["cpuset"] != "" {
+		hirPath := h.Path("cpuset")
+		for _, param := range mandatoryParameters["cpuset"] {
+			value, ok := cpuset[param]
+			if !ok {
+				continue
+			}
+			set, err := parseCpuList(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for cpuset.%s: %s", param, err)
+			}
+			buf, err := h.readInheritedParam("cpuset", param, hirPath)
+			if err != nil {
+				return err
+			}
+			allowed, err := parseCpuList(string(buf))
+			if err != nil {
+				return fmt.Errorf("can't parse cpuset.%s of the parent: %s", param, err)
+			}
+			for n, _ := range set {
+				if !allowed[n] {
+					return fmt.Errorf("cpuset.%s=%s isn't a subset of '%s' allowed by the parent",
+						param, value, strings.TrimSpace(string(buf)))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Default cpu.rt_period_us of a new cgroup
+const defaultRTPeriod = 1000000
+
+// rtBandwidth returns cpu.rt_runtime_us and cpu.rt_period_us to be written to
+// the hierarchy. The runtime is 0 if it's not given.
+func (h *Hierarchy) rtBandwidth() (runtime, period int64) {
+	cpu := h.Params["cpu"]
+	runtime, _ = strconv.ParseInt(cpu["rt_runtime_us"], 10, 64)
+	period, err := strconv.ParseInt(cpu["rt_period_us"], 10, 64)
+	if err != nil || period <= 0 {
+		period = defaultRTPeriod
+	}
+	return runtime, period
+}
+
+// readRTBandwidth reads cpu.rt_runtime_us and cpu.rt_period_us of the cgroup.
+// A cgroup which doesn't exist yet has no runtime as it's created so.
+func readRTBandwidth(dir string) (runtime, period int64) {
+	runtime, period = 0, defaultRTPeriod
+	if buf, err := FS.ReadFile(filepath.Join(dir, "cpu.rt_runtime_us")); err == nil {
+		runtime, _ = strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+	}
+	if buf, err := FS.ReadFile(filepath.Join(dir, "cpu.rt_period_us")); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64); err == nil && n > 0 {
+			period = n
+		}
+	}
+	return runtime, period
+}
+
+// hasRTBandwidth tells whether the cgroup has as much RT bandwidth as the
+// runtime in the period, -1 of the root being unlimited. Others taken by
+// siblings aren't considered.
+func hasRTBandwidth(dir string, runtime, period int64) bool {
+	r, p := readRTBandwidth(dir)
+	return r == -1 || r*period >= runtime*p
+}
+
+type rtBorrow struct {
+	dir     string
+	runtime int64
+}
+
+// borrowRTBandwidth raises cpu.rt_runtime_us of ancestors top-down which don't
+// have enough for the hierarchy. They're restored by Cleanup.
+func (h *Hierarchy) borrowRTBandwidth() error {
+	runtime, period := h.rtBandwidth()
+	if runtime <= 0 {
+		return nil
+	}
+	for _, dir := range h.ancestorPaths("cpu") {
+		if hasRTBandwidth(dir, runtime, period) {
+			continue
+		}
+		orig, p := readRTBandwidth(dir)
+		need := (runtime*p + period - 1) / period
+		Debugf("raising cpu.rt_runtime_us of %s from %d to %d", dir, orig, need)
+		if err := h.writeParam(dir, "cpu", "rt_runtime_us", strconv.FormatInt(need, 10)); err != nil {
+			return err
+		}
+		h.borrowed = append(h.borrowed, rtBorrow{dir, orig})
+	}
+	return nil
+}
+
+// returnRTBandwidth restores cpu.rt_runtime_us raised by borrowRTBandwidth,
+// bottom-up.
+func (h *Hierarchy) returnRTBandwidth() {
+	for i := len(h.borrowed) - 1; i >= 0; i-- {
+		b := h.borrowed[i]
+		value := strconv.FormatInt(b.runtime, 10)
+		backoff := cleanupBackoff
+		for j := 1; ; j++ {
+			err := h.writeParam(b.dir, "cpu", "rt_runtime_us", value)
+			if err == nil || errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			// Runtime of the removed child is released asynchronously
+			if j < cleanupAttempts && errors.Is(err, syscall.EINVAL) {
+				time.Sleep(backoff)
+				backoff *= 2
+				continue
+			}
+			Warnf("failed to restore cpu.rt_runtime_us of '%s': %s", b.dir, err)
+			break
+		}
+	}
+	h.borrowed = nil
+}
+
+// parseCpuList parses a list format of cpuset like 0-2,4 into a set.
+func parseCpuList(value string) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(strings.TrimSpace(value), ",") {
+		if part == "" {
+			continue
+		}
+		lo, hi := part, part
+		if dash := strings.Index(part, "-"); dash != -1 {
+			lo, hi = part[:dash], part[dash+1:]
+		}
+		from, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("malformed list '%s'", value)
+		}
+		to, err := strconv.Atoi(hi)
+		if err != nil || to < from {
+			return nil, fmt.Errorf("malformed list '%s'", value)
+		}
+		for n := from; n <= to; n++ {
+			set[n] = true
+		}
+	}
+	return set, nil
+}
+
+// inheritMandatoryParams copies mandatory parameters from the parent, except
+// for ones explicitly given in values.
+func (h *Hierarchy) inheritMandatoryParams(subsys, hirPath string, values map[string]string) error {
+	mandParams, ok := mandatoryParameters[subsys]
+	if !ok || cgroupV2 {
+		return nil
+	}
+	for _, param := range mandParams {
+		if _, ok := values[param]; ok {
+			continue
+		}
+		buf, err := h.readInheritedParam(subsys, param, hirPath)
+		if err != nil {
+			return err
+		}
+
+		if err := h.writeParam(hirPath, subsys, param, string(buf)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hierarchy) writeControlFile(path string, value []byte) error {
+	trimmed := strings.TrimRight(string(value), "\n")
+	if h.dryRun != nil {
+		fmt.Fprintf(h.dryRun, "set %s=%s in %s\n", filepath.Base(path), trimmed, filepath.Dir(path))
+		return nil
+	}
+	Debugf("writing '%s' to %s", trimmed, path)
+	return FS.WriteFile(path, value)
+}
+
+type paramWrite struct {
+	param, value string
+}
+
+// paramWrites returns writes to be done for the parameters of the subsystem
+// in order. It's the name order, e.g. memory.limit_in_bytes has to be written
+// before memory.memsw.limit_in_bytes, with a write for each rule of append
+// style parameters.
+func paramWrites(subsys string, values map[string]string) []paramWrite {
+	var names []string
+	for param, _ := range values {
+		names = append(names, param)
+	}
+	sort.Strings(names)
+
+	var writes []paramWrite
+	for _, param := range names {
+		if !IsAppendParam(subsys, param) {
+			writes = append(writes, paramWrite{param, values[param]})
+			continue
+		}
+		for _, rule := range strings.Split(values[param], "\n") {
+			writes = append(writes, paramWrite{param, rule})
+		}
+	}
+	if subsys == "devices" {
+		// A rule for all devices replaces the whole list, so it goes first
+		// and others are exceptions to it, e.g. devices.deny=a followed by
+		// devices.allow for the devices needed
+		sort.SliceStable(writes, func(i, j int) bool {
+			return isAllDevicesRule(writes[i].value) && !isAllDevicesRule(writes[j].value)
+		})
+	}
+	return writes
+}
+
+func isAllDevicesRule(rule string) bool {
+	f := strings.Fields(rule)
+	return len(f) > 0 && f[0] == "a"
+}
+
+// writeParam writes the parameter to the hierarchy. The error tells which
+// parameter and value have been rejected by the kernel.
+func (h *Hierarchy) writeParam(hirPath, subsys, param, value string) error {
+	path := filepath.Join(hirPath, subsys+"."+param)
+	if err := h.writeControlFile(path, []byte(value)); err != nil {
+		if pathErr, ok := err.(*os.PathError); ok {
+			err = pathErr.Err // Path is obvious from the parameter name
+		}
+		return &ErrParamWrite{Subsys: subsys, Param: param, Value: value, Err: err}
+	}
+	return nil
+}
+
+// Cleanup removes the hierarchy from every subsystem. The returned error
+// tells subsystems for which it couldn't be removed. It's done only once
+// even if called again or concurrently, e.g. from a signal handler, and the
+// later calls return the same error when it's done.
+func (h *Hierarchy) Cleanup() error {
+	h.cleanupOnce.Do(func() {
+		h.cleanupErr = h.cleanup()
+	})
+	return h.cleanupErr
+}
+
+func (h *Hierarchy) cleanup() error {
+	var subsyses []string
+	for subsys, _ := range h.Params {
+		subsyses = append(subsyses, subsys)
+	}
+	sort.Strings(subsyses)
+
+	// Frozen tasks can't leave the cgroup so they have to be thawed first
+	h.thaw()
+
+	var failed []string
+	removed := make(map[string]error) // Co-mounted subsystems share the path
+	for _, subsys := range subsyses {
+		mountPoint, ok := subsysMountPoints[subsys]
+		if !ok || mountPoint == "" {
+			continue
+		}
+
+		hirPath := h.Path(subsys)
+		err, ok := removed[hirPath]
+		if !ok {
+			err = removeHierarchyPath(hirPath)
+			removed[hirPath] = err
+		}
+		if err != nil {
+			failed = append(failed, subsys)
+		}
+	}
+	if h.restore && len(failed) == 0 {
+		h.disableControllers()
+	}
+	h.returnRTBandwidth()
+	if len(failed) > 0 {
+		return fmt.Errorf("hierarchy '%s' is left for subsystems: %s", h.Name, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Lookup finds the existing hierarchy of the name under the parent, which is
+// resolved in the same way as Spec.Parent. Params of the returned Hierarchy
+// has an empty entry for each subsystem the hierarchy is found in.
+func Lookup(parent, hirName string) (*Hierarchy, error) {
+	hirName = strings.TrimLeft(hirName, "/")
+	if !ValidName(hirName) {
+		return nil, fmt.Errorf("invalid cgroup name: '%s'", hirName)
+	}
+
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	var subsyses []string
+	for subsys, mountPoint := range subsysMountPoints {
+		if mountPoint != "" {
+			subsyses = append(subsyses, subsys)
+		}
+	}
+	parents, err := resolveParents(parent, 0, subsyses)
+	if err != nil {
+		return nil, err
+	}
+	h := &Hierarchy{Name: hirName, Params: make(map[string]map[string]string), parents: parents}
+	for _, subsys := range subsyses {
+		if fi, err := FS.Stat(h.Path(subsys)); err == nil && fi.IsDir() {
+			h.Params[subsys] = make(map[string]string)
+		}
+	}
+	if len(h.Params) == 0 {
+		return nil, fmt.Errorf("hierarchy '%s' is not found in any subsystem", hirName)
+	}
+	return h, nil
+}
+
+// ReadParams reads the current values of parameters of the hierarchy. Only
+// files which can be both read and written are parameters, stats and
+// write-only files like memory.force_empty are skipped.
+func (h *Hierarchy) ReadParams() (map[string]map[string]string, error) {
+	params := make(map[string]map[string]string)
+	for subsys, _ := range h.Params {
+		hirPath := h.Path(subsys)
+		files, err := FS.ReadDir(hirPath)
+		if err != nil {
+			return nil, err
+		}
+		params[subsys] = make(map[string]string)
+		for _, fi := range files {
+			// Co-mounted subsystems and cgroup core files share the directory
+			if fi.IsDir() || !strings.HasPrefix(fi.Name(), subsys+".") {
+				continue
+			}
+			if fi.Mode()&0600 != 0600 {
+				continue
+			}
+			buf, err := FS.ReadFile(filepath.Join(hirPath, fi.Name()))
+			if err != nil {
+				// Some are readable only on certain configurations
+				Debugf("skipping %s: %s", fi.Name(), err)
+				continue
+			}
+			params[subsys][strings.TrimPrefix(fi.Name(), subsys+".")] = strings.TrimSpace(string(buf))
+		}
+	}
+	return params, nil
+}
+
+// Remove removes the hierarchy of the name under the parent, e.g. one left
+// by a previous run. Since parameters it was created with are unknown, it's
+// looked up in every mounted subsystem.
+func Remove(parent, hirName string) error {
+	h, err := Lookup(parent, hirName)
+	if err != nil {
+		return err
+	}
+	return h.Cleanup()
+}
+
+// thaw thaws the v1 freezer cgroup of the hierarchy if any.
+func (h *Hierarchy) thaw() {
+	if _, ok := h.Params["freezer"]; !ok || cgroupV2 {
+		return
+	}
+	path := filepath.Join(h.Path("freezer"), "freezer.state")
+	if err := h.writeControlFile(path, []byte("THAWED")); err != nil && !os.IsNotExist(err) {
+		Warnf("failed to thaw '%s': %s", filepath.Dir(path), err)
+	}
+}
+
+// Tasks returns pids of processes in the hierarchy, including ones in cgroups
+// created inside of it.
+func (h *Hierarchy) Tasks() ([]int, error) {
+	paths, err := h.Paths()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool)
+	var pids []int
+	for _, hirPath := range paths {
+		err := walk(hirPath, func(path string, fi os.FileInfo) error {
+			if !fi.IsDir() {
+				return nil
+			}
+			buf, err := FS.ReadFile(filepath.Join(path, "cgroup.procs"))
+			if err != nil {
+				return err
+			}
+			for _, field := range strings.Fields(string(buf)) {
+				pid, err := strconv.Atoi(field)
+				if err == nil && !seen[pid] {
+					seen[pid] = true
+					pids = append(pids, pid)
+				}
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return pids, nil
+}
+
+const (
+	drainInterval  = 100 * time.Millisecond
+	drainKillGrace = time.Second
+)
+
+// Drain waits for processes left in the hierarchy, e.g. daemons the workload
+// has started, to exit so that it can be removed. After the timeout, they're
+// killed with SIGKILL if kill is true. It returns an error if any of them is
+// still there.
+func (h *Hierarchy) Drain(timeout time.Duration, kill bool) error {
+	deadline := time.Now().Add(timeout)
+	thawed := false
+	for {
+		pids, err := h.Tasks()
+		if err != nil {
+			return err
+		}
+		if len(pids) == 0 {
+			return nil
+		}
+		now := time.Now()
+		if now.After(deadline) {
+			if !kill || now.After(deadline.Add(drainKillGrace)) {
+				return fmt.Errorf("%d processes are left in hierarchy '%s'", len(pids), h.Name)
+			}
+			if !thawed {
+				// Frozen tasks don't die until thawed
+				h.thaw()
+				thawed = true
+			}
+			// Repeated for ones forked in the meantime
+			Debugf("killing %d processes left in hierarchy '%s'", len(pids), h.Name)
+			for _, pid := range pids {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+		time.Sleep(drainInterval)
+	}
+}
+
+const (
+	cleanupAttempts = 5
+	cleanupBackoff  = 50 * time.Millisecond
+)
+
+// removeHierarchyPath removes the hierarchy along with cgroups the workload
+// has created inside of it.
+func removeHierarchyPath(hirPath string) error {
+	var dirs []string
+	err := walk(hirPath, func(path string, fi os.FileInfo) error {
+		if fi.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		Warnf("failed to cleanup '%s': %s", hirPath, err)
+		return err
+	}
+
+	// walk visits parents first, so removing in reverse order goes bottom-up
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := removeCgroupDir(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeCgroupDir(hirPath string) error {
+	Debugf("removing %s", hirPath)
+	backoff := cleanupBackoff
+	for i := 1; ; i++ {
+		// This should not be RemoveAll since the cgroup is a special file system
+		// and does understand the mean of 'rmdir' operation for it's subdirectory.
+		err := FS.Remove(hirPath)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		// Tasks might be still on the way of leaving the cgroup
+		if i < cleanupAttempts && errors.Is(err, syscall.EBUSY) {
+			Debugf("%s is busy, retrying in %s", hirPath, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+			continue
+		}
+		Warnf("failed to cleanup '%s': %s", hirPath, err)
+		return err
+	}
+}
@@ -0,0 +1,212 @@
+//go:build linux
+// +build linux
+
+package cgroup
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSetupCleanup(t *testing.T) {
+	fs := useFakeFS(t, v1Files)
+	spec := Spec{
+		Parent: "/",
+		Name:   "team/job",
+		Params: map[string]map[string]string{
+			"cpu":    {"shares": "16"},
+			"memory": {"limit_in_bytes": "1073741824"},
+		},
+	}
+	h, err := spec.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Path("cpu"); got != "/sys/fs/cgroup/cpu/team/job" {
+		t.Errorf("Path(cpu) = %s", got)
+	}
+	if got := fs.Read(t, "/sys/fs/cgroup/cpu/team/job/cpu.shares"); got != "16" {
+		t.Errorf("cpu.shares = %q, want 16", got)
+	}
+	if got := fs.Read(t, "/sys/fs/cgroup/memory/team/job/memory.limit_in_bytes"); got != "1073741824" {
+		t.Errorf("memory.limit_in_bytes = %q, want 1073741824", got)
+	}
+
+	if err := h.Attach(100); err != nil {
+		t.Fatal(err)
+	}
+	pids, err := h.Tasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pids, []int{100}) {
+		t.Errorf("Tasks() = %v, want [100]", pids)
+	}
+
+	// The process has exited
+	fs.Write(t, "/sys/fs/cgroup/cpu/team/job/cgroup.procs", "")
+	fs.Write(t, "/sys/fs/cgroup/memory/team/job/cgroup.procs", "")
+	if err := h.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/sys/fs/cgroup/cpu/team/job", "/sys/fs/cgroup/memory/team/job"} {
+		if fs.Exists(path) {
+			t.Errorf("%s is left", path)
+		}
+	}
+}
+
+func TestSetupRollback(t *testing.T) {
+	fs := useFakeFS(t, v1Files)
+	fs.Write(t, "/sys/fs/cgroup/cpu/team/cgroup.procs", "")
+	spec := Spec{
+		Parent: "/",
+		Name:   "team/batch/job",
+		Params: map[string]map[string]string{
+			"cpu": {"shares": "16", "no_such_param": "1"},
+		},
+	}
+	_, err := spec.Setup()
+	var unknownErr *ErrUnknownParam
+	if !errors.As(err, &unknownErr) {
+		t.Fatalf("Setup() error = %v, want ErrUnknownParam", err)
+	}
+	if fs.Exists("/sys/fs/cgroup/cpu/team/batch") {
+		t.Error("intermediate cgroup created by Setup is left")
+	}
+	if !fs.Exists("/sys/fs/cgroup/cpu/team") {
+		t.Error("existing intermediate cgroup is removed")
+	}
+}
+
+func TestParseCpuList(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  []int
+	}{
+		{"", nil},
+		{"0", []int{0}},
+		{"0-2,4", []int{0, 1, 2, 4}},
+		{"1,3-3\n", []int{1, 3}},
+	} {
+		set, err := parseCpuList(tc.value)
+		if err != nil {
+			t.Errorf("parseCpuList(%q) error = %v", tc.value, err)
+			continue
+		}
+		want := make(map[int]bool)
+		for _, n := range tc.want {
+			want[n] = true
+		}
+		if !reflect.DeepEqual(set, want) {
+			t.Errorf("parseCpuList(%q) = %v, want %v", tc.value, set, want)
+		}
+	}
+	for _, value := range []string{"a", "2-1", "0-", "-1"} {
+		if _, err := parseCpuList(value); err == nil {
+			t.Errorf("parseCpuList(%q) succeeded", value)
+		}
+	}
+}
+
+func TestSetupCanceled(t *testing.T) {
+	fs := useFakeFS(t, v1Files)
+	cancel := make(chan struct{})
+	close(cancel)
+	spec := Spec{
+		Parent: "/",
+		Name:   "team/job",
+		Params: map[string]map[string]string{"cpu": {"shares": "16"}},
+		Cancel: cancel,
+	}
+	if _, err := spec.Setup(); !errors.Is(err, ErrCanceled) {
+		t.Fatalf("Setup() error = %v, want ErrCanceled", err)
+	}
+	if fs.Exists("/sys/fs/cgroup/cpu/team") {
+		t.Error("cgroup is left after canceled")
+	}
+}
+
+func TestSetupExisting(t *testing.T) {
+	fs := useFakeFS(t, v1Files)
+	fs.Write(t, "/sys/fs/cgroup/cpu/job/cgroup.procs", "")
+	spec := Spec{
+		Parent: "/",
+		Name:   "job",
+		Params: map[string]map[string]string{"cpu": {"shares": "16"}},
+	}
+	_, err := spec.Setup()
+	var existErr *ErrHierarchyExists
+	if !errors.As(err, &existErr) {
+		t.Fatalf("Setup() error = %v, want ErrHierarchyExists", err)
+	}
+	if !fs.Exists("/sys/fs/cgroup/cpu/job") {
+		t.Error("existing hierarchy is removed")
+	}
+
+	spec.SuffixOnConflict = true
+	h, err := spec.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Name != "job-1" {
+		t.Errorf("Name = %s, want job-1", h.Name)
+	}
+}
+
+func TestCleanupRestoreControllers(t *testing.T) {
+	for _, restore := range []bool{false, true} {
+		fs := useFakeFS(t, map[string]string{
+			"/proc/cgroups":                         "#subsys_name\thierarchy\tnum_cgroups\tenabled\ncpu\t0\t1\t1\n",
+			"/proc/mounts":                          "cgroup2 /sys/fs/cgroup cgroup2 rw 0 0\n",
+			"/sys/fs/cgroup/cgroup.controllers":     "cpu\n",
+			"/sys/fs/cgroup/cgroup.subtree_control": "",
+			"/sys/fs/cgroup/cgroup.procs":           "",
+		})
+		spec := Spec{
+			Params:             map[string]map[string]string{"cpu": {}},
+			RestoreControllers: restore,
+		}
+		h, err := spec.Setup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fs.Read(t, "/sys/fs/cgroup/cgroup.subtree_control"); got != "+cpu" {
+			t.Errorf("cgroup.subtree_control after Setup = %q, want +cpu", got)
+		}
+		if err := h.Cleanup(); err != nil {
+			t.Fatal(err)
+		}
+		want := "+cpu"
+		if restore {
+			want = "-cpu"
+		}
+		if got := fs.Read(t, "/sys/fs/cgroup/cgroup.subtree_control"); got != want {
+			t.Errorf("cgroup.subtree_control after Cleanup with RestoreControllers=%v = %q, want %s", restore, got, want)
+		}
+	}
+}
+
+func TestResolveParentsV2(t *testing.T) {
+	useFakeFS(t, map[string]string{
+		"/proc/cgroups":                     "#subsys_name\thierarchy\tnum_cgroups\tenabled\ncpu\t0\t1\t1\n",
+		"/proc/mounts":                      "cgroup2 /sys/fs/cgroup cgroup2 rw 0 0\n",
+		"/proc/1/cgroup":                    "0::/\n",
+		"/proc/123/cgroup":                  "0::/system.slice/foo.service\n",
+		"/sys/fs/cgroup/cgroup.controllers": "cpu\n",
+	})
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	parents, err := resolveParents("", 1, []string{"cpu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parents["cpu"] != "/" {
+		t.Errorf("parent of pid 1 = %s, want /", parents["cpu"])
+	}
+	if _, err := resolveParents("", 123, []string{"cpu"}); err == nil {
+		t.Error("cgroup having processes is resolved as the parent on v2")
+	}
+}
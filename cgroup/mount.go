@@ -0,0 +1,233 @@
+//go:build linux
+// +build linux
+
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var subsysMountPoints = make(map[string]string)
+
+// Mount point of the cgroup v2 unified hierarchy, and whether it's the only
+// hierarchy available on this system (no controller is bound to v1).
+var (
+	unifiedMountPoint string
+	cgroupV2          bool
+)
+
+// MountRoot is the directory under which subsystems are mounted, e.g.
+// /sys/fs/cgroup. If set before Init, subsystems are looked up as its
+// subdirectories like MountRoot/cpu, or MountRoot itself is used as the v2
+// hierarchy if it has cgroup.controllers, instead of reading /proc/mounts.
+var MountRoot string
+
+// Version forces the cgroup version to use if set to 1 or 2 before Init.
+// By default v1 hierarchies are used if any controller is bound to them,
+// otherwise the v2 one, which matters on hybrid systems having both.
+var Version int
+
+var (
+	initOnce sync.Once
+	initErr  error
+)
+
+// Init finds out available subsystems and where they're mounted. It's called
+// by Setup and Remove as well, so calling it explicitly is needed only for
+// MountPoints and V2.
+func Init() error {
+	initOnce.Do(func() {
+		initErr = initMountPointMap()
+	})
+	return initErr
+}
+
+// Reset forgets what Init has found, so that the next Init looks subsystems
+// up again, e.g. after FS or MountRoot has been replaced.
+func Reset() {
+	initOnce = sync.Once{}
+	initErr = nil
+	subsysMountPoints = make(map[string]string)
+	unifiedMountPoint = ""
+	cgroupV2 = false
+}
+
+// MountPoints returns available subsystems and their mount points. The
+// mount point is empty for subsystems which aren't mounted.
+func MountPoints() map[string]string {
+	mountPoints := make(map[string]string)
+	for subsys, mountPoint := range subsysMountPoints {
+		mountPoints[subsys] = mountPoint
+	}
+	return mountPoints
+}
+
+// V2 tells whether the system has the cgroup v2 unified hierarchy only.
+func V2() bool {
+	return cgroupV2
+}
+
+func initMountPointMap() error {
+	// First, read available cgroup subsystems
+	entries, err := FS.ReadFile("/proc/cgroups")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("cgroups not available: /proc/cgroups missing, are you on Linux with cgroups enabled?")
+		}
+		return err
+	}
+	for _, line := range strings.Split(string(entries), "\n")[1:] {
+		f := strings.Fields(line)
+		if len(f) < 1 {
+			continue
+		}
+
+		subsysMountPoints[f[0]] = ""
+	}
+
+	if MountRoot != "" {
+		if err := readMountRoot(); err != nil {
+			return err
+		}
+	} else if err := readProcMounts(); err != nil {
+		return err
+	}
+	switch Version {
+	case 1:
+		unifiedMountPoint = ""
+	case 2:
+		if unifiedMountPoint == "" {
+			return fmt.Errorf("cgroup v2 hierarchy is not mounted")
+		}
+		for subsys, _ := range subsysMountPoints {
+			subsysMountPoints[subsys] = ""
+		}
+	}
+
+	for subsys, mountPoint := range subsysMountPoints {
+		Debugf("subsystem %s is mounted at '%s'", subsys, mountPoint)
+	}
+	for _, mountPoint := range subsysMountPoints {
+		if mountPoint != "" {
+			// At least one controller is on a v1 hierarchy
+			return nil
+		}
+	}
+	if unifiedMountPoint == "" {
+		return nil
+	}
+	Debugf("using cgroup v2 hierarchy mounted at %s", unifiedMountPoint)
+
+	// v2 only system, every available controller lives in the single hierarchy
+	buf, err := FS.ReadFile(filepath.Join(unifiedMountPoint, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	cgroupV2 = true
+	for _, subsys := range strings.Fields(string(buf)) {
+		subsysMountPoints[subsys] = unifiedMountPoint
+		Debugf("subsystem %s is available in v2 hierarchy", subsys)
+	}
+
+	return nil
+}
+
+// readProcMounts finds mount points of subsystems from /proc/mounts.
+func readProcMounts() error {
+	entries, err := FS.ReadFile("/proc/mounts")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(entries), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 {
+			continue
+		}
+
+		if f[2] == "cgroup2" {
+			if unifiedMountPoint == "" {
+				unifiedMountPoint = f[1]
+			}
+			continue
+		}
+		if f[2] != "cgroup" {
+			continue
+		}
+		for _, opt := range strings.Split(f[3], ",") {
+			if _, ok := subsysMountPoints[opt]; ok {
+				subsysMountPoints[opt] = f[1] // path
+			}
+		}
+	}
+	return nil
+}
+
+// readMountRoot finds subsystems mounted under MountRoot. Co-mounted ones
+// like cpu,cpuacct are usually symlinked to, which are resolved so that
+// they're known to share the directory.
+func readMountRoot() error {
+	if _, err := FS.Stat(filepath.Join(MountRoot, "cgroup.controllers")); err == nil && Version != 1 {
+		unifiedMountPoint = MountRoot
+		return nil
+	}
+	for subsys, _ := range subsysMountPoints {
+		mountPoint, err := FS.EvalSymlinks(filepath.Join(MountRoot, subsys))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if fi, err := FS.Stat(mountPoint); err == nil && fi.IsDir() {
+			subsysMountPoints[subsys] = mountPoint
+		}
+	}
+	return nil
+}
+
+// ProcessCgroups returns the cgroup path of the process for each subsystem,
+// read from /proc/PID/cgroup.
+func ProcessCgroups(pid int) (map[string]string, error) {
+	buf, err := FS.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	cgroups := make(map[string]string)
+	for _, line := range strings.Split(string(buf), "\n") {
+		// ID:SUBSYS[,SUBSYS...]:PATH, where SUBSYS is empty for v2
+		f := strings.SplitN(line, ":", 3)
+		if len(f) < 3 {
+			continue
+		}
+		if f[1] == "" && cgroupV2 {
+			for subsys, _ := range subsysMountPoints {
+				cgroups[subsys] = f[2]
+			}
+			continue
+		}
+		for _, subsys := range strings.Split(f[1], ",") {
+			if subsys != "" && !strings.HasPrefix(subsys, "name=") {
+				cgroups[subsys] = f[2]
+			}
+		}
+	}
+	return cgroups, nil
+}
+
+// Threads makes pids written to v1 hierarchies move only the thread by
+// writing them to tasks, instead of cgroup.procs moving the whole process.
+var Threads bool
+
+// TasksFileName returns the name of the file to which pids are written to
+// move processes into a cgroup.
+func TasksFileName() string {
+	if Threads && !cgroupV2 {
+		return "tasks"
+	}
+	return "cgroup.procs"
+}
@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package cgroup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInitReset(t *testing.T) {
+	useFakeFS(t, map[string]string{
+		"/proc/cgroups": "#subsys_name\thierarchy\tnum_cgroups\tenabled\n" +
+			"cpu\t0\t1\t1\n" +
+			"memory\t0\t1\t1\n" +
+			"freezer\t0\t1\t1\n",
+		"/proc/mounts":                          "cgroup2 /sys/fs/cgroup cgroup2 rw 0 0\n",
+		"/sys/fs/cgroup/cgroup.controllers":     "cpu memory\n",
+		"/sys/fs/cgroup/cgroup.subtree_control": "\n",
+	})
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	if !V2() {
+		t.Error("V2() = false on a v2 only system")
+	}
+	want := map[string]string{"cpu": "/sys/fs/cgroup", "memory": "/sys/fs/cgroup", "freezer": ""}
+	if got := MountPoints(); !reflect.DeepEqual(got, want) {
+		t.Errorf("MountPoints() = %v, want %v", got, want)
+	}
+
+	useFakeFS(t, v1Files)
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	if V2() {
+		t.Error("V2() = true after Reset on a v1 system")
+	}
+	want = map[string]string{"cpu": "/sys/fs/cgroup/cpu", "memory": "/sys/fs/cgroup/memory"}
+	if got := MountPoints(); !reflect.DeepEqual(got, want) {
+		t.Errorf("MountPoints() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,118 @@
+//go:build linux
+// +build linux
+
+package cgroup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Subsystems which have no counterpart in cgroup v2
+var v1OnlySubsystems = map[string]bool{
+	"blkio":    true, // except for the translated parameters below
+	"cpuacct":  true,
+	"devices":  true,
+	"freezer":  true,
+	"net_cls":  true,
+	"net_prio": true,
+}
+
+type v2Param struct {
+	name    string // subsys.param in v2
+	convert func(value string) (string, error)
+}
+
+var v2ParamTranslations = map[string]v2Param{
+	"cpu.shares":                 {"cpu.weight", convertShares},
+	"blkio.weight":               {"io.weight", convertBlkioWeight},
+	"memory.limit_in_bytes":      {"memory.max", convertUnlimited},
+	"memory.soft_limit_in_bytes": {"memory.low", convertUnlimited},
+}
+
+// cpu.shares(2..262144) -> cpu.weight(1..10000)
+func convertShares(value string) (string, error) {
+	shares, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid cpu.shares value '%s'", value)
+	}
+	if shares < 2 {
+		shares = 2
+	} else if shares > 262144 {
+		shares = 262144
+	}
+	return strconv.FormatUint(1+((shares-2)*9999)/262142, 10), nil
+}
+
+// blkio.weight(10..1000) -> io.weight(1..10000)
+func convertBlkioWeight(value string) (string, error) {
+	weight, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || weight < 10 || weight > 1000 {
+		return "", fmt.Errorf("invalid blkio.weight value '%s'", value)
+	}
+	return strconv.FormatUint(1+((weight-10)*9999)/990, 10), nil
+}
+
+func convertUnlimited(value string) (string, error) {
+	if value == "-1" {
+		return "max", nil
+	}
+	return value, nil
+}
+
+// translateV2Params rewrites v1 style parameters into their v2 equivalents.
+// Parameters which are already in v2 style are passed through as is.
+func translateV2Params(params map[string]map[string]string) (map[string]map[string]string, error) {
+	translated := make(map[string]map[string]string)
+	set := func(name, value string) {
+		sep := strings.Index(name, ".")
+		subsys := name[:sep]
+		if _, ok := translated[subsys]; !ok {
+			translated[subsys] = make(map[string]string)
+		}
+		translated[subsys][name[sep+1:]] = value
+	}
+
+	for subsys, values := range params {
+		if len(values) == 0 && !v1OnlySubsystems[subsys] {
+			// Just to be created, e.g. the scratch hierarchy of --check
+			translated[subsys] = make(map[string]string)
+		}
+		for param, value := range values {
+			name := subsys + "." + param
+			if name == "cpu.cfs_quota_us" || name == "cpu.cfs_period_us" {
+				continue // Merged into cpu.max below
+			}
+			if tr, ok := v2ParamTranslations[name]; ok {
+				newValue, err := tr.convert(value)
+				if err != nil {
+					return nil, err
+				}
+				set(tr.name, newValue)
+				continue
+			}
+			if v1OnlySubsystems[subsys] {
+				return nil, fmt.Errorf("parameter '%s' is not supported on cgroup v2", name)
+			}
+			if name == "memory.memsw.limit_in_bytes" {
+				return nil, fmt.Errorf("parameter '%s' is not supported on cgroup v2, use memory.swap.max instead", name)
+			}
+			set(name, value)
+		}
+	}
+
+	quota, hasQuota := params["cpu"]["cfs_quota_us"]
+	period, hasPeriod := params["cpu"]["cfs_period_us"]
+	if hasQuota || hasPeriod {
+		if !hasQuota || quota == "-1" {
+			quota = "max"
+		}
+		if !hasPeriod {
+			period = "100000"
+		}
+		set("cpu.max", quota+" "+period)
+	}
+
+	return translated, nil
+}
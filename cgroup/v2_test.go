@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package cgroup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTranslateV2Params(t *testing.T) {
+	for _, tc := range []struct {
+		params map[string]map[string]string
+		want   map[string]map[string]string
+	}{
+		{
+			map[string]map[string]string{"cpu": {"shares": "1024"}, "pids": {"max": "10"}},
+			map[string]map[string]string{"cpu": {"weight": "39"}, "pids": {"max": "10"}},
+		},
+		{
+			map[string]map[string]string{"memory": {"limit_in_bytes": "-1", "soft_limit_in_bytes": "1024"}},
+			map[string]map[string]string{"memory": {"max": "max", "low": "1024"}},
+		},
+		{
+			map[string]map[string]string{"cpu": {"cfs_quota_us": "50000"}},
+			map[string]map[string]string{"cpu": {"max": "50000 100000"}},
+		},
+		{
+			map[string]map[string]string{"cpu": {"cfs_quota_us": "-1", "cfs_period_us": "10000"}},
+			map[string]map[string]string{"cpu": {"max": "max 10000"}},
+		},
+		{
+			map[string]map[string]string{"memory": {}},
+			map[string]map[string]string{"memory": {}},
+		},
+		{
+			map[string]map[string]string{"blkio": {"weight": "1000"}},
+			map[string]map[string]string{"io": {"weight": "10000"}},
+		},
+	} {
+		got, err := translateV2Params(tc.params)
+		if err != nil {
+			t.Errorf("translateV2Params(%v) error = %v", tc.params, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("translateV2Params(%v) = %v, want %v", tc.params, got, tc.want)
+		}
+	}
+
+	for _, params := range []map[string]map[string]string{
+		{"freezer": {"state": "FROZEN"}},
+		{"memory": {"memsw.limit_in_bytes": "1024"}},
+		{"cpu": {"shares": "many"}},
+		{"blkio": {"weight": "1"}},
+	} {
+		if _, err := translateV2Params(params); err == nil {
+			t.Errorf("translateV2Params(%v) succeeded", params)
+		}
+	}
+}
@@ -1,217 +1,523 @@
+//go:build linux
+// +build linux
+
 package main
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jessevdk/go-flags"
+	"github.com/kawamuray/cgrun/cgroup"
+	"golang.org/x/sys/unix"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
 const HelperInitProgName = "__cgrun_init__"
 
-var mandatoryParameters = map[string][]string{
-	"cpuset": []string{
-		"cpus",
-		"mems",
-	},
-}
+// Exit statuses telling why the hierarchy couldn't be set up, 1 is used for
+// other failures
+const (
+	ExitSubsysNotMounted = 3
+	ExitUnknownParam     = 4
+	ExitHierarchyExists  = 5
+	ExitPermissionDenied = 6
+)
 
-var subsysMountPoints = make(map[string]string)
+// Exit status with --strict-cleanup when the hierarchy couldn't be removed
+// after the program exits, overriding the program's one
+const ExitCleanupFailed = 7
 
-func initMountPointMap() error {
-	// First, read available cgroup subsystems
-	entries, err := ioutil.ReadFile("/proc/cgroups")
-	if err != nil {
-		return err
-	}
-	for _, line := range strings.Split(string(entries), "\n")[1:] {
-		f := strings.Fields(line)
-		if len(f) < 1 {
-			continue
-		}
+// Exit statuses of the helper when it fails before running the program, same
+// as the shell and env(1)
+const (
+	ExitHelperFailed = 125
+	ExitCannotExec   = 126
+	ExitNotFound     = 127
+)
 
-		subsysMountPoints[f[0]] = ""
-	}
+// Interval to scan the process tree for --follow-exec
+const followInterval = time.Second
 
-	entries, err = ioutil.ReadFile("/proc/mounts")
-	if err != nil {
-		return err
-	}
-	for _, line := range strings.Split(string(entries), "\n") {
-		f := strings.Fields(line)
-		if len(f) < 4 {
-			continue
-		}
+const (
+	// Exit status when the program has been terminated by --timeout, same as timeout(1)
+	TimeoutExitStatus = 124
+	// Time to wait after SIGTERM before sending SIGKILL by --timeout
+	TimeoutKillGrace = 5 * time.Second
+)
 
-		if f[2] != "cgroup" {
-			continue
-		}
-		for _, opt := range strings.Split(f[3], ",") {
-			if _, ok := subsysMountPoints[opt]; ok {
-				subsysMountPoints[opt] = f[1] // path
-			}
-		}
+// infof prints a non-error diagnostic unless --quiet is given.
+func infof(format string, args ...interface{}) {
+	if !opts.Quiet {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
 	}
+}
 
-	return nil
+func debugf(format string, args ...interface{}) {
+	if opts.Verbose {
+		fmt.Fprintf(os.Stderr, "cgrun: "+format+"\n", args...)
+	}
 }
 
-func makeHierarchyName() string {
-	// This might be unique at the moment
-	seed := time.Now().Unix() + int64(os.Getpid())
-	hash := md5.New()
-	fmt.Fprintf(hash, "%d", seed)
-	return hex.EncodeToString(hash.Sum(nil))
+func setupExitStatus(err error) int {
+	var (
+		notMounted   *cgroup.ErrSubsysNotMounted
+		unknownParam *cgroup.ErrUnknownParam
+		exists       *cgroup.ErrHierarchyExists
+	)
+	switch {
+	case errors.As(err, &notMounted):
+		return ExitSubsysNotMounted
+	case errors.As(err, &unknownParam):
+		return ExitUnknownParam
+	case errors.As(err, &exists):
+		return ExitHierarchyExists
+	case errors.Is(err, os.ErrPermission), errors.Is(err, syscall.EROFS):
+		return ExitPermissionDenied
+	}
+	return 1
 }
 
-var childStarted = false
+// Read from the signal handler goroutine
+var (
+	childStarted atomic.Bool
+	// Set once the program has exited and the hierarchy is being removed
+	cleaningUp atomic.Bool
+)
 
 func setupSignalHandler(handler func()) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
 	go func() {
-		<-sigCh
-		if !childStarted {
+		for sig := range sigCh {
+			if cleaningUp.Load() {
+				// Draining or retrying a busy cgroup may take long, give
+				// up on it rather than ignoring as the program is gone
+				os.Exit(128 + int(sig.(syscall.Signal)))
+			}
+			if childStarted.Load() {
+				// The child gets it as well and decides what to do
+				continue
+			}
+			// Exit like the shell does for a program killed by the signal
+			status := 128 + int(sig.(syscall.Signal))
+			go func() {
+				// Cleanup may hang retrying a busy cgroup, give up on it
+				// at the second signal
+				<-sigCh
+				os.Exit(status)
+			}()
 			handler()
+			os.Exit(status)
 		}
 	}()
 }
 
-func setupHierarchy(hirName string, params map[string]map[string]string) (err error) {
-	// Now we have to ensure that the cleanup will be done even in case of signaled
-	setupSignalHandler(func() {
-		cleanupHierarchy(hirName, params)
-	})
-	defer func() {
-		if err != nil {
-			cleanupHierarchy(hirName, params)
-		}
-	}()
+// Accounting files reported by --stats for each subsystem
+var statsFiles = map[string][]string{
+	"cpuacct": []string{"usage", "stat"},
+	"memory":  []string{"max_usage_in_bytes", "failcnt"},
+	"blkio":   []string{"throttle.io_service_bytes"},
+	"pids":    []string{"current", "max", "events"},
+}
 
-	for subsys, values := range params {
-		mountPoint, ok := subsysMountPoints[subsys]
-		if !ok || mountPoint == "" {
-			return fmt.Errorf("subsystem '%s' is not mounted", subsys)
-		}
+var statsFilesV2 = map[string][]string{
+	"cpu":    []string{"stat"},
+	"memory": []string{"peak", "events"},
+	"io":     []string{"stat"},
+	"pids":   []string{"current", "peak", "max", "events"},
+}
 
-		hirPath := filepath.Join(mountPoint, hirName)
-		if err := os.Mkdir(hirPath, 0750); err != nil {
-			return err
-		}
-		if opts.Uid != "" {
-			uid, _ := strconv.Atoi(opts.user.Uid)
-			gid, _ := strconv.Atoi(opts.user.Gid)
-			err := filepath.Walk(hirPath, func(path string, _ os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				return os.Chown(path, uid, gid)
-			})
+// printStats reads back accounting files of the hierarchy and prints them,
+// along with rusage of the program in exec mode. Files which don't exist on
+// this kernel are skipped silently.
+func printStats(h *cgroup.Hierarchy) {
+	files := statsFiles
+	if cgroup.V2() {
+		files = statsFilesV2
+	}
+
+	var subsyses []string
+	for subsys, _ := range h.Params {
+		subsyses = append(subsyses, subsys)
+	}
+	sort.Strings(subsyses)
+
+	for _, subsys := range subsyses {
+		for _, file := range files[subsys] {
+			name := subsys + "." + file
+			buf, err := ioutil.ReadFile(filepath.Join(h.Path(subsys), name))
 			if err != nil {
-				return err
+				continue
+			}
+			lines := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+			if len(lines) == 1 {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", name, lines[0])
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "%s:\n", name)
+			for _, line := range lines {
+				fmt.Fprintf(os.Stderr, "  %s\n", line)
 			}
 		}
+	}
 
-		if mandParams, ok := mandatoryParameters[subsys]; ok {
-			// Copy mandatory parameters from parent hierarchy
-			for _, param := range mandParams {
-				parentPath := filepath.Join(filepath.Dir(hirPath), subsys+"."+param)
-				buf, err := ioutil.ReadFile(parentPath)
-				if err != nil {
-					return err
-				}
+	if programRusage != nil {
+		// The process' view, which doesn't include descendants it hasn't
+		// waited for unlike the hierarchy's
+		fmt.Fprintf(os.Stderr, "rusage.utime: %s\n", time.Duration(programRusage.Utime.Nano()))
+		fmt.Fprintf(os.Stderr, "rusage.stime: %s\n", time.Duration(programRusage.Stime.Nano()))
+		fmt.Fprintf(os.Stderr, "rusage.maxrss: %d kB\n", programRusage.Maxrss)
+	}
+}
 
-				path := filepath.Join(hirPath, subsys+"."+param)
-				if err := ioutil.WriteFile(path, buf, 0); err != nil {
-					return err
-				}
-			}
+// Status of the hierarchy printed by --json
+type hierarchyStatus struct {
+	Name   string                       `json:"name"`
+	Paths  map[string]string            `json:"paths"`
+	Params map[string]map[string]string `json:"params"`
+	Pids   []int                        `json:"pids"`
+}
+
+// Where --json output goes. Not stdout unless --status-fd 1 as the program
+// may have written to it by the time the status is printed.
+var statusOut io.Writer = os.Stderr
+
+// printHierarchy tells the hierarchy name once processes are put into it.
+func printHierarchy(h *cgroup.Hierarchy, pids []int) error {
+	if !opts.Json {
+		infof("%s", h.Name)
+		return nil
+	}
+
+	status := hierarchyStatus{
+		Name:   h.Name,
+		Paths:  make(map[string]string),
+		Params: h.Params,
+		Pids:   pids,
+	}
+	for subsys, _ := range h.Params {
+		status.Paths[subsys] = h.Path(subsys)
+	}
+	return json.NewEncoder(statusOut).Encode(status)
+}
+
+// printKeptHierarchy tells where the hierarchy has been left with --keep.
+func printKeptHierarchy(h *cgroup.Hierarchy) {
+	paths, err := h.Paths()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	for _, path := range paths {
+		infof("kept cgroup hierarchy: %s", path)
+	}
+}
+
+// helperSpec tells helperMain what to do before exec'ing the program. It's
+// passed as a single argument so that it's never confused with the program's
+// arguments.
+type helperSpec struct {
+	Uid int `json:"uid"`
+	Gid int `json:"gid"`
+	// Supplementary groups, kept as is when empty
+	Groups     []int    `json:"groups,omitempty"`
+	TasksFiles []string `json:"tasks_files"`
+	// Shell command run in the hierarchy before exec'ing the program
+	PreExec string `json:"pre_exec,omitempty"`
+	// Working directory and $PATH of the program, inherited if empty
+	Dir  string `json:"dir,omitempty"`
+	Path string `json:"path,omitempty"`
+	// Start from an empty environment having only KeepEnv of ours instead
+	// of all, then KEY=VALUE in Env are set over it
+	ClearEnv bool     `json:"clear_env,omitempty"`
+	KeepEnv  []string `json:"keep_env,omitempty"`
+	Env      []string `json:"env,omitempty"`
+}
+
+// Search path used when the environment of the program has no PATH, same as
+// execvp(3) of glibc
+const defaultSearchPath = "/bin:/usr/bin"
+
+// lookupProgram finds the program in PATH of the environment which the
+// program gets, so that --env PATH=... and --inherit-env=false apply to
+// which one is run as well.
+func lookupProgram(name string, env []string) (string, error) {
+	path := defaultSearchPath
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			path = kv[len("PATH="):]
 		}
+	}
+	// LookPath reads it from our environment, which isn't used anymore
+	os.Setenv("PATH", path)
+	binPath, err := exec.LookPath(name)
+	if errors.Is(err, exec.ErrDot) {
+		// Found through a relative entry like --path bin:/usr/bin, which is
+		// resolved against the working directory as execvp(3) does
+		return binPath, nil
+	}
+	return binPath, err
+}
 
-		for param, val := range values {
-			path := filepath.Join(hirPath, subsys+"."+param)
-			if err := ioutil.WriteFile(path, []byte(val), 0); err != nil {
-				return err
+// programEnv builds the environment of the program from ours.
+func (spec *helperSpec) programEnv() []string {
+	var base []string
+	if spec.ClearEnv {
+		for _, key := range spec.KeepEnv {
+			if value, ok := os.LookupEnv(key); ok {
+				base = append(base, key+"="+value)
 			}
 		}
+	} else {
+		base = os.Environ()
+	}
+	overrides := spec.Env
+	if spec.Path != "" {
+		overrides = append(overrides, "PATH="+spec.Path)
 	}
 
-	return nil
-}
-
-func cleanupHierarchy(hirName string, params map[string]map[string]string) {
-	for subsys, _ := range params {
-		mountPoint, ok := subsysMountPoints[subsys]
-		if !ok || mountPoint == "" {
+	// Replace in place rather than appending, the first one wins in getenv(3)
+	index := make(map[string]int)
+	var env []string
+	for _, kv := range append(base, overrides...) {
+		key := kv
+		if sep := strings.Index(kv, "="); sep != -1 {
+			key = kv[:sep]
+		}
+		if i, ok := index[key]; ok {
+			env[i] = kv
 			continue
 		}
+		index[key] = len(env)
+		env = append(env, kv)
+	}
+	return env
+}
 
-		hirPath := filepath.Join(mountPoint, hirName)
-		// This should not be RemoveAll since the cgroup is a special file system
-		// and does understand the mean of 'rmdir' operation for it's subdirectory.
-		if err := os.Remove(hirPath); err != nil && !os.IsNotExist(err) {
-			fmt.Fprintf(os.Stderr, "failed to cleanup '%s': %s\n", hirPath, err)
+// lookupUser finds the user either by uid or by username.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		// Assume it's a uid
+		return user.LookupId(name)
+	}
+	// Assume it's a username
+	return user.Lookup(name)
+}
+
+// lookupGroup finds the group either by gid or by group name.
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		// Assume it's a gid
+		return user.LookupGroupId(name)
+	}
+	// Assume it's a group name
+	return user.LookupGroup(name)
+}
+
+// lookupExecCredential fills opts.execCred with the credential which the
+// program runs as. --user and --group take precedence over --uid.
+func lookupExecCredential() error {
+	usr := opts.user
+	if opts.User != "" {
+		var err error
+		if usr, err = lookupUser(opts.User); err != nil {
+			return fmt.Errorf("can't obtain user info from '%s': %s", opts.User, err)
+		}
+	}
+	cred := &helperSpec{}
+	cred.Uid, _ = strconv.Atoi(usr.Uid)
+	cred.Gid, _ = strconv.Atoi(usr.Gid)
+	if opts.Uid != "" || opts.User != "" {
+		// Don't let the program keep supplementary groups of the invoker
+		gids, err := usr.GroupIds()
+		if err != nil {
+			return fmt.Errorf("can't obtain groups of '%s': %s", usr.Username, err)
+		}
+		for _, gid := range gids {
+			n, _ := strconv.Atoi(gid)
+			cred.Groups = append(cred.Groups, n)
 		}
 	}
+	if opts.Group != "" {
+		grp, err := lookupGroup(opts.Group)
+		if err != nil {
+			return fmt.Errorf("can't obtain group info from '%s': %s", opts.Group, err)
+		}
+		cred.Gid, _ = strconv.Atoi(grp.Gid)
+		if cred.Groups == nil {
+			cred.Groups = []int{cred.Gid}
+		}
+	}
+	opts.execCred = cred
+	return nil
 }
 
-func getTasksFiles(hirName string, params map[string]map[string]string) ([]string, error) {
-	var helperArgs []string
-	for subsys, _ := range params {
-		mountPoint, ok := subsysMountPoints[subsys]
-		if !ok || mountPoint == "" {
-			return nil, fmt.Errorf("subsystem '%s' is not mounted", subsys)
+// signalProgram signals the program, or its whole process group with --setpgid.
+func signalProgram(p *os.Process, sig syscall.Signal) error {
+	if opts.Setpgid {
+		return syscall.Kill(-p.Pid, sig)
+	}
+	return p.Signal(sig)
+}
+
+// terminateProgram signals the program and the rest of processes in the
+// hierarchy, as descendants e.g. children of sh -c aren't in the process
+// group of the program unless --setpgid and would be left otherwise.
+func terminateProgram(p *os.Process, h *cgroup.Hierarchy, sig syscall.Signal) {
+	signalProgram(p, sig)
+	if h == nil {
+		return
+	}
+	pids, err := h.Tasks()
+	if err != nil {
+		debugf("failed to list processes to terminate: %s", err)
+		return
+	}
+	for _, pid := range pids {
+		if pid != p.Pid {
+			syscall.Kill(pid, sig)
 		}
-		helperArgs = append(helperArgs, filepath.Join(mountPoint, hirName, "tasks"))
 	}
-	return helperArgs, nil
 }
 
-func execProgram(hirName string, params map[string]map[string]string, args []string) (int, error) {
-	helperArgs := []string{
-		string(opts.user.Uid),
-		string(opts.user.Gid),
+// Resource usage of the program and its descendants it has waited for,
+// filled by execProgram once the program exits
+var programRusage *syscall.Rusage
+
+// selfExecutable returns the path to re-exec cgrun itself as the helper.
+func selfExecutable() (string, error) {
+	selfPath, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		// e.g. /proc isn't mounted in a chroot
+		if selfPath, err = exec.LookPath(os.Args[0]); err != nil {
+			return "", fmt.Errorf("can't find the cgrun binary to run the program: %s", err)
+		}
+		return selfPath, nil
 	}
+	if strings.HasSuffix(selfPath, " (deleted)") {
+		// The binary was removed or replaced after we started, the link
+		// still executes the one running
+		debugf("cgrun binary %s, executing it through /proc/self/exe", selfPath)
+		return "/proc/self/exe", nil
+	}
+	return selfPath, nil
+}
 
-	tasksFiles, err := getTasksFiles(hirName, params)
+// execProgram runs the program in the cgroups of tasksFiles. started is
+// called once the program has joined them. h is the hierarchy whose
+// processes are terminated with the program by --timeout, nil for cgroups
+// which aren't ours.
+func execProgram(tasksFiles []string, h *cgroup.Hierarchy, started func(pid int) error, args []string) (int, error) {
+	spec := *opts.execCred
+	spec.TasksFiles = tasksFiles
+	spec.PreExec = opts.PreExec
+	spec.Dir = opts.Chdir
+	spec.Path = opts.Path
+	spec.ClearEnv = opts.InheritEnv == "false"
+	spec.KeepEnv = opts.KeepEnv
+	spec.Env = opts.Env
+	specJson, err := json.Marshal(spec)
 	if err != nil {
 		return -1, err
 	}
-	helperArgs = append(helperArgs, tasksFiles...)
-	helperArgs = append(helperArgs, "--")
-	helperArgs = append(helperArgs, args...)
+	helperArgs := append([]string{string(specJson)}, args...)
 
-	selfPath, err := os.Readlink("/proc/self/exe")
+	selfPath, err := selfExecutable()
 	if err != nil {
 		return -1, err
 	}
 	cmd := exec.Command(selfPath, helperArgs...)
 	cmd.Args[0] = HelperInitProgName
+	// *os.File are passed to the program as is rather than copied through a
+	// pipe by goroutines, so nothing in cgrun blocks on reading stdin and
+	// Wait returns once the program exits even if its descendants keep them
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if opts.Setpgid {
+		// The program and its descendants form a process group whose pgid
+		// is the program's pid, cgrun stays out of it.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
 
 	if err := cmd.Start(); err != nil {
 		return -1, err
 	}
 	// Below just ignore a signal.
 	// Child will be exit by propagated signal and we'll gonna exit properly.
-	childStarted = true
-	fmt.Fprintln(os.Stderr, hirName)
+	childStarted.Store(true)
+	if err := started(cmd.Process.Pid); err != nil {
+		return -1, err
+	}
+
+	if opts.ForwardSignals {
+		// For the case cgrun is signaled alone by e.g, a supervisor, rather
+		// than the whole foreground process group by the terminal.
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		defer func() {
+			signal.Stop(sigCh)
+			close(sigCh)
+		}()
+		go func() {
+			for sig := range sigCh {
+				debugf("forwarding %s to pid %d", sig, cmd.Process.Pid)
+				signalProgram(cmd.Process, sig.(syscall.Signal))
+			}
+		}()
+	}
 
-	if err := cmd.Wait(); err != nil {
+	var timedOut atomic.Bool
+	exited := make(chan struct{})
+	if opts.Timeout > 0 {
+		go func() {
+			select {
+			case <-exited:
+				return
+			case <-time.After(opts.Timeout):
+			}
+			timedOut.Store(true)
+			infof("timed out after %s, terminating the program", opts.Timeout)
+			terminateProgram(cmd.Process, h, syscall.SIGTERM)
+
+			select {
+			case <-exited:
+				return
+			case <-time.After(TimeoutKillGrace):
+			}
+			terminateProgram(cmd.Process, h, syscall.SIGKILL)
+		}()
+	}
+
+	err = cmd.Wait()
+	close(exited)
+	if rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		programRusage = rusage
+	}
+	if timedOut.Load() {
+		return TimeoutExitStatus, nil
+	}
+	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				if status.Signaled() {
+					// Same as the shell convention
+					return 128 + int(status.Signal()), nil
+				}
 				return status.ExitStatus(), nil
 			}
 		}
@@ -220,79 +526,360 @@ func execProgram(hirName string, params map[string]map[string]string, args []str
 	return 0, nil
 }
 
+// PID_MAX_LIMIT of the kernel, pids are never as large as this
+const pidMaxLimit = 1 << 22
+
+// isPidFile tells whether the entry of /proc is a process.
 func isPidFile(name string) bool {
+	if name == "" || name[0] == '0' {
+		return false // No process has pid 0 nor is listed with leading zeros
+	}
 	for _, c := range name {
 		if c < '0' || c > '9' {
 			return false
 		}
 	}
-	return true
+	pid, err := strconv.Atoi(name)
+	return err == nil && pid < pidMaxLimit
 }
 
-func collectPids(pid string, tasksFiles []string) error {
-	pidByte := []byte(pid)
-	for _, tasksFile := range tasksFiles {
-		if err := ioutil.WriteFile(tasksFile, pidByte, 0); err != nil {
+// Original cgroups of processes attached with --move-back
+var origins = make(map[int]map[string]string)
+
+// attach attaches the process, remembering where it was for --move-back.
+func attach(h *cgroup.Hierarchy, pid int) error {
+	if _, ok := origins[pid]; opts.MoveBack && !ok {
+		cgroups, err := cgroup.ProcessCgroups(pid)
+		if err != nil {
 			return err
 		}
+		origins[pid] = cgroups
 	}
+	return h.Attach(pid)
+}
 
+// moveBack returns processes attached with --move-back to their original
+// cgroups. Ones which have already exited are skipped.
+func moveBack(h *cgroup.Hierarchy) {
+	for pid, cgroups := range origins {
+		if err := h.MoveBack(pid, cgroups); err != nil && !errors.Is(err, syscall.ESRCH) {
+			fmt.Fprintf(os.Stderr, "failed to move back process %d: %s\n", pid, err)
+		}
+	}
+}
+
+// collectPids attaches the process, and its descendants with --tree. Pids
+// attached are added to the tree along with their depth from the process
+// given by -p, so that each of them is visited only once.
+func collectPids(h *cgroup.Hierarchy, pid int, tree map[string]int) error {
+	if err := attach(h, pid); err != nil {
+		return err
+	}
+	tree[strconv.Itoa(pid)] = 0
 	if !opts.Tree {
 		return nil
 	}
+	return collectTree(h, tree)
+}
 
-	// Search for my children
-	dp, err := os.Open("/proc")
-	if err != nil {
-		return err
+// collectTree attaches all descendants of the root process. Children forked
+// after their parent has been attached are born in the hierarchy, but the
+// ones forked by a parent not attached yet can be missed by a single pass
+// over /proc, so it's scanned until two consecutive passes find nothing new.
+// A process reparented to init before it's found still escapes. Stop the
+// tree beforehand (e.g. kill -STOP) if that matters.
+func collectTree(h *cgroup.Hierarchy, tree map[string]int) error {
+	for idle := 0; idle < 2; {
+		found, err := scanChildren(h, tree)
+		if err != nil {
+			return err
+		}
+		if found {
+			idle = 0
+		} else {
+			idle++
+		}
 	}
-	dirEnts, err := dp.Readdirnames(-1)
-	dp.Close()
+	return nil
+}
+
+// scanChildren attaches processes whose parent is in the tree and adds them
+// to the tree, up to --max-tree-depth. It tells whether any new process was
+// found.
+func scanChildren(h *cgroup.Hierarchy, tree map[string]int) (bool, error) {
+	dirEnts, err := cgroup.FS.ReadDir("/proc")
 	if err != nil {
-		return err
+		return false, err
 	}
-	for _, name := range dirEnts {
-		if !isPidFile(name) {
+
+	found := false
+	for _, ent := range dirEnts {
+		name := ent.Name()
+		if _, ok := tree[name]; !isPidFile(name) || ok {
 			continue
 		}
-		buf, err := ioutil.ReadFile("/proc/" + name + "/stat")
+		ppid, err := readPpid(name)
 		if err != nil {
-			return err
+			if exited(err) {
+				continue // Exited while scanning
+			}
+			return false, err
+		}
+		depth, ok := tree[ppid]
+		if !ok || (opts.MaxTreeDepth > 0 && depth >= opts.MaxTreeDepth) {
+			continue
 		}
-		f := strings.Fields(string(buf))
-		if f[3] == pid {
-			if err := collectPids(f[0], tasksFiles); err != nil {
-				return err
+		pid, _ := strconv.Atoi(name)
+		if err := attach(h, pid); err != nil {
+			if exited(err) {
+				continue // Exited while scanning
 			}
+			return false, err
 		}
+		tree[name] = depth + 1
+		found = true
 	}
+	return found, nil
+}
 
-	return nil
+// exited tells whether the error is due to the process which has gone away.
+// /proc/PID disappears once it's reaped, but reading a file of a process
+// being reaped can fail with ESRCH as well.
+func exited(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ESRCH)
 }
 
-// TODO probably this can be done better by using memory.oom_control
-func waitNonChildPid(pid int) {
+// readPpid returns the parent pid of the given process.
+func readPpid(pid string) (string, error) {
+	buf, err := cgroup.FS.ReadFile("/proc/" + pid + "/stat")
+	if err != nil {
+		return "", err
+	}
+	// The comm field is wrapped in parentheses but it can contain spaces and
+	// parentheses by itself, so fields are counted from the last ')'.
+	// pid (comm) state ppid ...
+	stat := string(buf)
+	sep := strings.LastIndex(stat, ")")
+	if sep == -1 {
+		return "", fmt.Errorf("malformed stat of pid %s", pid)
+	}
+	f := strings.Fields(stat[sep+1:])
+	if len(f) < 2 {
+		return "", fmt.Errorf("malformed stat of pid %s", pid)
+	}
+	return f[1], nil
+}
+
+// openPidfd returns a pidfd of the process or -1 if it isn't supported.
+// Opening it before attaching the process ensures that we keep referring
+// the same process even if the pid has been reused while waiting.
+func openPidfd(pid int) int {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		debugf("can't open pidfd for %d: %s", pid, err)
+		return -1
+	}
+	return fd
+}
+
+// waitNonChildPid waits for the process until it exits. It blocks on pidfd
+// if available, otherwise falls back to polling.
+func waitNonChildPid(pid, pidfd int) {
+	if pidfd >= 0 {
+		defer unix.Close(pidfd)
+		fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+		for {
+			_, err := unix.Poll(fds, -1)
+			if err == nil {
+				return
+			}
+			if err != unix.EINTR {
+				debugf("failed to poll pidfd for %d: %s", pid, err)
+				break
+			}
+		}
+	}
+
 	for syscall.Kill(pid, 0) == nil {
 		time.Sleep(500 * time.Millisecond)
 	}
 }
 
-func seizePid(hirName string, params map[string]map[string]string, pid int) error {
-	childStarted = true
-	tasksFiles, err := getTasksFiles(hirName, params)
+func seizePids(h *cgroup.Hierarchy, pids []int) error {
+	childStarted.Store(true)
+	// Processes aren't ours so signals from the terminal don't reach them.
+	// Stop waiting instead so that e.g, frozen processes can be thawed. It's
+	// registered before attaching them so that one during a long scan of
+	// the tree still does it once they're all attached.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	// SIGHUP writes the parameters again, e.g. after the parent's cpuset
+	// has changed
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+	pidfds := make([]int, len(pids))
+	for i, pid := range pids {
+		pidfds[i] = openPidfd(pid)
+	}
+	tree := make(map[string]int)
+	for _, pid := range pids {
+		if err := collectPids(h, pid, tree); err != nil {
+			if opts.MoveBack {
+				moveBack(h) // Ones attached so far
+			}
+			return fmt.Errorf("can't attach to process %d: %s", pid, err)
+		}
+	}
+	if err := printHierarchy(h, pids); err != nil {
+		return err
+	}
+	if opts.WaitMode == "nowait" {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i, pid := range pids {
+			waitNonChildPid(pid, pidfds[i])
+		}
+		close(done)
+	}()
+	stopFollow := make(chan struct{})
+	followDone := make(chan struct{})
+	go func() {
+		defer close(followDone)
+		if !opts.FollowExec {
+			return
+		}
+		for {
+			select {
+			case <-stopFollow:
+				return
+			case <-time.After(followInterval):
+			}
+			if err := collectTree(h, tree); err != nil {
+				debugf("failed to follow the process tree: %s", err)
+			}
+		}
+	}()
+wait:
+	for {
+		select {
+		case <-done:
+			break wait
+		case sig := <-sigCh:
+			debugf("stop waiting by %s", sig)
+			break wait
+		case <-hupCh:
+			if err := h.Reapply(); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to re-apply parameters: %s\n", err)
+			} else {
+				infof("re-applied parameters to %s", h.Name)
+			}
+		}
+	}
+	close(stopFollow)
+	<-followDone
+	if opts.MoveBack {
+		moveBack(h)
+	}
+	return nil
+}
+
+// writeNameFile writes the hierarchy name to the file. It's renamed from a
+// temporary file so that readers never see it partially written.
+func writeNameFile(path, name string) error {
+	fp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
 	if err != nil {
 		return err
 	}
-	if err := collectPids(fmt.Sprintf("%d", pid), tasksFiles); err != nil {
+	_, err = fmt.Fprintln(fp, name)
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(fp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+	}
+	return err
+}
+
+// listSubsystems prints available subsystems and where they're mounted.
+func listSubsystems() error {
+	if err := cgroup.Init(); err != nil {
 		return err
 	}
-	fmt.Fprintln(os.Stderr, hirName)
-	waitNonChildPid(pid)
+
+	subsysMountPoints := cgroup.MountPoints()
+	var subsyses []string
+	for subsys, _ := range subsysMountPoints {
+		subsyses = append(subsyses, subsys)
+	}
+	sort.Strings(subsyses)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	for _, subsys := range subsyses {
+		mountPoint := subsysMountPoints[subsys]
+		if mountPoint == "" {
+			mountPoint = "not mounted"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", subsys, mountPoint)
+	}
+	return w.Flush()
+}
+
+// showHierarchy prints current parameters of the existing hierarchy in
+// subsys.param=value form which can be given to cgrun again.
+func showHierarchy(name string) error {
+	h, err := cgroup.Lookup(opts.Parent, name)
+	if err != nil {
+		return err
+	}
+	params, err := h.ReadParams()
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for subsys, values := range params {
+		for param, value := range values {
+			if value == "" || strings.Contains(value, "\n") {
+				// Can't be given back as a parameter
+				debugf("skipping %s.%s which is empty or has multiple lines", subsys, param)
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s.%s=%s", subsys, param, value))
+		}
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Println(line)
+	}
 	return nil
 }
 
-func initialMain() int {
-	args, err := flags.ParseArgs(&opts, os.Args[1:])
+// splitArgs splits arguments at the first --, after which everything is the
+// program's even if it looks like our option or a parameter. An option never
+// takes -- as its value, so the first one is always the separator.
+func splitArgs(args []string) (cgrunArgs, program []string, hasSep bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:], true
+		}
+	}
+	return args, nil, false
+}
+
+func initialMain() (status int) {
+	cgrunArgs, program, hasSep := splitArgs(os.Args[1:])
+	args, err := flags.ParseArgs(&opts, cgrunArgs)
 	if err != nil {
 		if err.(*flags.Error).Type == flags.ErrHelp {
 			return 0
@@ -301,24 +888,62 @@ func initialMain() int {
 			return 1
 		}
 	}
+	cgroup.Debugf = debugf
+	cgroup.MountRoot = opts.CgroupRoot
+	if opts.StatusFd != 0 {
+		// Not to be inherited by the program
+		if _, err := unix.FcntlInt(uintptr(opts.StatusFd), unix.F_SETFD, unix.FD_CLOEXEC); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid status fd %d: %s\n", opts.StatusFd, err)
+			return 1
+		}
+		statusOut = os.NewFile(uintptr(opts.StatusFd), "status")
+		opts.Json = true
+	}
+	cgroup.Threads = opts.Thread
+	if opts.V1 && opts.V2 {
+		fmt.Fprintln(os.Stderr, "--v1 and --v2 can't be used together")
+		return 1
+	} else if opts.V1 {
+		cgroup.Version = 1
+	} else if opts.V2 {
+		cgroup.Version = 2
+	}
 
-	baseParent := opts.Parent
-	for len(baseParent) > 0 && baseParent[0] == '/' {
-		baseParent = baseParent[1:]
+	if opts.List {
+		if err := listSubsystems(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to build cgroup fs mount point map: %s\n", err)
+			return 1
+		}
+		if err := listLabels(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read labels: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+	if opts.Check {
+		if !checkEnvironment() {
+			return 1
+		}
+		return 0
+	}
+	if opts.Show != "" {
+		if err := showHierarchy(opts.Show); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	if opts.Cleanup != "" {
+		if err := cgroup.Remove(opts.Parent, opts.Cleanup); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		removeLabels(strings.TrimLeft(opts.Cleanup, "/"))
+		return 0
 	}
 
 	if opts.Uid != "" {
-		var (
-			usr *user.User
-			err error
-		)
-		if _, err = strconv.Atoi(opts.Uid); err == nil {
-			// Assume it's a uid
-			usr, err = user.LookupId(opts.Uid)
-		} else {
-			// Assume it's a username
-			usr, err = user.Lookup(opts.Uid)
-		}
+		usr, err := lookupUser(opts.Uid)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "can't obtain user info from '%s': %s\n", opts.Uid, err)
 			return 1
@@ -332,119 +957,549 @@ func initialMain() int {
 		}
 		opts.user = usr
 	}
+	if err := lookupExecCredential(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
 
 	params := make(map[string]map[string]string)
+	if opts.Config != "" {
+		// Read first so that parameters in the command line take precedence
+		if err := readConfigFile(opts.Config, params); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read config file: %s\n", err)
+			return 1
+		}
+	}
+	if err := readEnvParams(os.Environ(), params); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for subsys, args := range map[string][]string{"cpu": opts.Cpu, "memory": opts.Memory, "blkio": opts.Blkio} {
+		for _, arg := range args {
+			if err := parseGroupedParams(subsys, arg, params); err != nil {
+				fmt.Fprintf(os.Stderr, "--%s: %s\n", subsys, err)
+				return 1
+			}
+		}
+	}
 	for i, arg := range args {
-		sep := strings.Index(arg, "=")
-		if sep == -1 {
-			if arg == "--" {
-				i++
+		if !strings.Contains(arg, "=") {
+			if hasSep {
+				fmt.Fprintf(os.Stderr, "unexpected argument '%s' before --, parameters must be SUBSYS.PARAM=VALUE\n", arg)
+				return 1
 			}
-			args = args[i:]
+			// The program without --
+			program = args[i:]
 			break
 		}
-		// cpu.shares=1024 -> cpu.shares(param), 1024(value)
-		param := arg[:sep]
-		value := arg[sep+1:]
-		sep = strings.Index(param, ".")
-		if sep == -1 {
-			fmt.Fprintf(os.Stderr, "incorrect parameter name: '%s'\n", param)
+		subsys, param, value, err := parseParam(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		setParam(params, subsys, param, value)
+	}
+	args = program
+	if opts.Shell != "" {
+		if len(args) > 0 {
+			fmt.Fprintln(os.Stderr, "--shell can't be used with a program")
 			return 1
 		}
-		// cpu.shares -> cpu(subsys), shares
-		subsys := param[:sep]
-		if _, ok := params[subsys]; !ok {
-			params[subsys] = make(map[string]string)
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
 		}
-		params[subsys][param[sep+1:]] = value
+		args = []string{shell, "-c", opts.Shell}
 	}
 
-	if err := initMountPointMap(); err != nil {
+	if err := cgroup.Init(); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to build cgroup fs mount point map: %s\n", err)
 		return 1
 	}
+	if opts.Freeze {
+		setParam(params, "freezer", "state", "FROZEN")
+	}
+	if opts.MaxPids != "" {
+		value, err := normalizeValue("pids", "max", opts.MaxPids)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		setParam(params, "pids", "max", value)
+	}
+	if opts.CpuLimit != "" {
+		quota, err := cpuLimitQuota(opts.CpuLimit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		setParam(params, "cpu", "cfs_period_us", strconv.Itoa(cpuLimitPeriod))
+		setParam(params, "cpu", "cfs_quota_us", quota)
+	}
+
+	if opts.Name != "" && !cgroup.ValidName(opts.Name) {
+		fmt.Fprintf(os.Stderr, "invalid cgroup name: '%s'\n", opts.Name)
+		return 1
+	}
 
-	hirName := baseParent + makeHierarchyName()
-	if err := setupHierarchy(hirName, params); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to setup cgroup hierarchy: %s\n", err)
+	if opts.Thread && len(opts.Pid) == 0 {
+		// The helper would move only its own thread and the program might
+		// be exec'd from another one, escaping the hierarchy
+		fmt.Fprintln(os.Stderr, "--thread can be used only with -p")
+		return 1
+	}
+
+	if len(opts.Into) > 0 {
+		if len(params) > 0 || len(opts.Pid) > 0 || opts.Name != "" {
+			fmt.Fprintln(os.Stderr, "--into can't be used with parameters, --name or -p")
+			return 1
+		}
+		return execInto(opts.Into, args)
+	}
+
+	if opts.AttachSelf {
+		if len(args) > 0 || len(opts.Pid) > 0 {
+			fmt.Fprintln(os.Stderr, "--attach-self can't be used with a program or -p")
+			return 1
+		}
+		// Same as -p PPID --wait-mode nowait, the shell and what it runs
+		// later stay in the hierarchy after we exit
+		opts.Pid = []int{os.Getppid()}
+		opts.WaitMode = "nowait"
+	}
+	for _, pid := range opts.Pid {
+		if pid <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid pid %d\n", pid)
+			return 1
+		}
+	}
+	if opts.MaxTreeDepth < 0 {
+		fmt.Fprintf(os.Stderr, "invalid tree depth %d\n", opts.MaxTreeDepth)
+		return 1
+	}
+	if opts.MoveBack && (len(opts.Pid) == 0 || opts.WaitMode == "nowait") {
+		fmt.Fprintln(os.Stderr, "--move-back can be used only with -p without --wait-mode nowait")
+		return 1
+	}
+	if opts.Freeze {
+		if len(opts.Pid) == 0 {
+			// cgrun itself would be frozen before running the program
+			fmt.Fprintln(os.Stderr, "--freeze can be used only with -p")
+			return 1
+		}
+		// Thawing isn't enough for the hierarchy to be removed, the
+		// processes have to leave it
+		if opts.WaitMode != "nowait" {
+			opts.MoveBack = true
+		}
+	}
+	if opts.FollowExec {
+		if len(opts.Pid) == 0 || opts.WaitMode == "nowait" {
+			fmt.Fprintln(os.Stderr, "--follow-exec can be used only with -p without --wait-mode nowait")
+			return 1
+		}
+		opts.Tree = true
+	}
+	if len(opts.Pid) > 0 && opts.WaitMode == "nowait" {
+		// The processes are still in the hierarchy when we return
+		opts.Keep = true
+	}
+	for _, kv := range opts.Env {
+		if strings.Index(kv, "=") <= 0 {
+			fmt.Fprintf(os.Stderr, "incorrect environment variable: '%s', must be KEY=VALUE\n", kv)
+			return 1
+		}
+	}
+	labels, err := parseLabels(opts.Label)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if opts.ParentFromPid != 0 {
+		if opts.Parent != "" {
+			fmt.Fprintln(os.Stderr, "--parent and --parent-from-pid can't be used together")
+			return 1
+		}
+		if opts.ParentFromPid < 0 {
+			fmt.Fprintf(os.Stderr, "invalid pid %d\n", opts.ParentFromPid)
+			return 1
+		}
+	}
+
+	spec := cgroup.Spec{
+		Parent:    opts.Parent,
+		ParentPid: opts.ParentFromPid,
+		Name:      opts.Name,
+		Params:    params,
+	}
+	if opts.Uid != "" {
+		spec.Owner = &cgroup.Owner{}
+		spec.Owner.Uid, _ = strconv.Atoi(opts.user.Uid)
+		spec.Owner.Gid, _ = strconv.Atoi(opts.user.Gid)
+	}
+	if opts.Group != "" {
+		// Let members of the group read the hierarchy along with --dir-mode
+		if spec.Owner == nil {
+			spec.Owner = &cgroup.Owner{Uid: -1}
+		}
+		spec.Owner.Gid = opts.execCred.Gid
+	}
+	if opts.DirMode != "" {
+		mode, err := strconv.ParseUint(opts.DirMode, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			fmt.Fprintf(os.Stderr, "invalid directory mode: '%s'\n", opts.DirMode)
+			return 1
+		}
+		spec.DirMode = os.FileMode(mode)
+	}
+	spec.IgnoreUnsupported = opts.IgnoreUnsupported
+	spec.NoInherit = opts.NoInherit
+	spec.BorrowRT = opts.BorrowRT
+	spec.SuffixOnConflict = opts.OnConflict == "suffix"
+	spec.NotifyOnRelease = opts.NotifyOnRelease
+	if opts.MaxSiblings < 0 {
+		fmt.Fprintf(os.Stderr, "invalid max siblings %d\n", opts.MaxSiblings)
 		return 1
 	}
-	defer cleanupHierarchy(hirName, params)
+	spec.MaxSiblings = opts.MaxSiblings
+	if opts.DryRun {
+		spec.DryRun = os.Stdout
+	} else if opts.PrintPaths {
+		spec.DryRun = ioutil.Discard
+	}
+
+	// Now we have to ensure that the cleanup will be done even in case of signaled
+	var hierarchy atomic.Pointer[cgroup.Hierarchy]
+	cancelSetup := make(chan struct{})
+	setupDone := make(chan struct{})
+	spec.Cancel = cancelSetup
+	setupSignalHandler(func() {
+		select {
+		case <-setupDone:
+		default:
+			// Setup undoes what it has done so far and fails
+			close(cancelSetup)
+			<-setupDone
+		}
+		if h := hierarchy.Load(); h != nil && !opts.Keep {
+			if err := h.Cleanup(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	})
+	h, err := spec.Setup()
+	if err == nil && spec.DryRun == nil {
+		hierarchy.Store(h)
+	}
+	close(setupDone)
+	if errors.Is(err, cgroup.ErrCanceled) {
+		select {} // The signal handler exits with 128+N
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to setup cgroup hierarchy: %s\n", err)
+		return setupExitStatus(err)
+	}
+	if opts.PrintPaths {
+		paths, err := h.Paths()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, path := range paths {
+			fmt.Println(path)
+		}
+		return 0
+	}
+	if opts.DryRun {
+		return 0
+	}
+	if len(labels) > 0 {
+		if err := saveLabels(h, labels); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to save labels: %s\n", err)
+		}
+	}
+	if opts.Keep {
+		defer printKeptHierarchy(h)
+	} else {
+		defer func() {
+			cleaningUp.Store(true)
+			if opts.DrainTimeout > 0 || opts.KillOnCleanup {
+				if err := h.Drain(opts.DrainTimeout, opts.KillOnCleanup); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
+			if err := h.Cleanup(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				if opts.StrictCleanup {
+					printLeakedPaths(h)
+					status = ExitCleanupFailed
+				}
+			} else if len(labels) > 0 {
+				removeLabels(h.Name)
+			}
+		}()
+	}
+
+	if opts.NameFile != "" {
+		if err := writeNameFile(opts.NameFile, h.Name); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write the hierarchy name: %s\n", err)
+			return 1
+		}
+	}
 
-	if opts.Pid != nil {
-		if *opts.Pid <= 0 {
-			fmt.Fprintf(os.Stderr, "invalid pid %d\n", *opts.Pid)
+	if _, ok := h.Params["memory"]; ok {
+		// Only for reporting, the program runs without it
+		if w, err := watchOOM(h.Path("memory")); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to watch OOM events, they won't be reported: %s\n", err)
+		} else {
+			// Deferred after cleanup so that this runs before it
+			defer w.stop()
+		}
+	}
+	if opts.WatchThrottle {
+		if _, ok := h.Params["cpu"]; !ok {
+			fmt.Fprintln(os.Stderr, "--watch-throttle needs a cpu parameter like cpu.cfs_quota_us")
 			return 1
 		}
-		if err := seizePid(hirName, params, *opts.Pid); err != nil {
-			fmt.Fprintf(os.Stderr, "can't attach to process %d: %s\n", *opts.Pid, err)
+		defer watchThrottle(h.Path("cpu")).stop()
+	}
+	if opts.EventLog != "" {
+		l, err := startEventLog(opts.EventLog, h)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open event log: %s\n", err)
 			return 1
 		}
+		defer l.stop()
+	}
+
+	if len(opts.Pid) > 0 {
+		if err := seizePids(h, opts.Pid); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if opts.Stats {
+			printStats(h)
+		}
 		return 0
 	} else {
 		if len(args) == 0 {
 			fmt.Fprintf(os.Stderr, "no target program specified\n")
 			return 1
 		}
-		exitStatus, err := execProgram(hirName, params, args)
+		tasksFiles, err := h.TasksFiles()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to execute command: %s\n", err)
 			return 1
 		}
+		started := func(pid int) error { return printHierarchy(h, []int{pid}) }
+		exitStatus, err := execProgram(tasksFiles, h, started, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to execute command: %s\n", err)
+			return 1
+		}
+		if opts.Stats {
+			printStats(h)
+		}
 		return exitStatus
 	}
 }
 
-func helperMain() {
-	uid, _ := strconv.Atoi(os.Args[1])
-	gid, _ := strconv.Atoi(os.Args[2])
-	if err := syscall.Setgid(gid); err != nil {
-		fmt.Fprintf(os.Stderr, "can't set gid: %s", err)
+// printLeakedPaths prints directories of the hierarchy still existing after
+// the cleanup failed.
+func printLeakedPaths(h *cgroup.Hierarchy) {
+	paths, err := h.Paths()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	if err := syscall.Setuid(uid); err != nil {
-		fmt.Fprintf(os.Stderr, "can't set uid: %s", err)
-		return
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			fmt.Fprintf(os.Stderr, "leaked cgroup hierarchy: %s\n", path)
+		}
 	}
+}
 
-	args := os.Args[3:]
-	pid := []byte(fmt.Sprintf("%d", os.Getpid()))
-	for i, arg := range args {
-		if arg == "--" {
-			args = args[i+1:]
-			break
+// execInto runs the program in existing cgroups without creating or
+// removing anything.
+func execInto(paths []string, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "no target program specified\n")
+		return 1
+	}
+	var tasksFiles []string
+	for _, path := range paths {
+		tasksFile := filepath.Join(path, cgroup.TasksFileName())
+		if _, err := os.Stat(tasksFile); err != nil {
+			fmt.Fprintf(os.Stderr, "'%s' is not a cgroup: %s\n", path, err)
+			return 1
 		}
-		if err := ioutil.WriteFile(arg, pid, 0); err != nil {
-			fmt.Fprintf(os.Stderr, "can't write pid to %s: %s\n", arg, err)
-			return
+		tasksFiles = append(tasksFiles, tasksFile)
+	}
+	// Nothing to clean up, but signals have to be left to the program once
+	// it's started rather than killing cgrun and losing its exit status
+	setupSignalHandler(func() {})
+	exitStatus, err := execProgram(tasksFiles, nil, func(int) error { return nil }, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to execute command: %s\n", err)
+		return 1
+	}
+	return exitStatus
+}
+
+func helperMain() int {
+	// __cgrun_init__ SPEC PROGRAM [ARGS...]
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, "no program to exec")
+		return ExitHelperFailed
+	}
+	var spec helperSpec
+	if err := json.Unmarshal([]byte(os.Args[1]), &spec); err != nil {
+		fmt.Fprintf(os.Stderr, "malformed helper spec: %s\n", err)
+		return ExitHelperFailed
+	}
+	args := os.Args[2:]
+
+	// Join the hierarchy while still privileged, then drop privileges
+	for _, tasksFile := range spec.TasksFiles {
+		if err := cgroup.WritePid(tasksFile, os.Getpid()); err != nil {
+			var emptyCpuset *cgroup.ErrEmptyCpuset
+			if errors.As(err, &emptyCpuset) {
+				fmt.Fprintln(os.Stderr, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "can't write pid to %s: %s\n", tasksFile, err)
+			}
+			return ExitHelperFailed
 		}
 	}
 
-	binPath, err := exec.LookPath(args[0])
+	if len(spec.Groups) > 0 {
+		if err := syscall.Setgroups(spec.Groups); err != nil {
+			fmt.Fprintf(os.Stderr, "can't set supplementary groups: %s\n", err)
+			return ExitHelperFailed
+		}
+	}
+	if err := syscall.Setgid(spec.Gid); err != nil {
+		fmt.Fprintf(os.Stderr, "can't set gid: %s\n", err)
+		return ExitHelperFailed
+	}
+	if err := syscall.Setuid(spec.Uid); err != nil {
+		fmt.Fprintf(os.Stderr, "can't set uid: %s\n", err)
+		return ExitHelperFailed
+	}
+
+	// As the user so that its permission applies
+	if spec.Dir != "" {
+		if err := os.Chdir(spec.Dir); err != nil {
+			fmt.Fprintf(os.Stderr, "can't change directory: %s\n", err)
+			return ExitHelperFailed
+		}
+	}
+	env := spec.programEnv()
+	if spec.PreExec != "" {
+		// Forked as we're replaced by the program below
+		cmd := exec.Command("/bin/sh", "-c", spec.PreExec)
+		cmd.Env = env
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "pre-exec command failed: %s\n", err)
+			return ExitHelperFailed
+		}
+	}
+
+	binPath, err := lookupProgram(args[0], env)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to lookup path of '%s': %s\n", args[0], err)
-		return
+		if errors.Is(err, os.ErrPermission) {
+			return ExitCannotExec
+		}
+		return ExitNotFound
 	}
 
-	if err := syscall.Exec(binPath, args, os.Environ()); err != nil {
-		fmt.Fprintf(os.Stderr, "can't exec '%s': %s\n", args[0], err)
+	err = syscall.Exec(binPath, args, env)
+	fmt.Fprintf(os.Stderr, "can't exec '%s': %s\n", args[0], err)
+	if errors.Is(err, syscall.ENOENT) {
+		return ExitNotFound // e.g. the interpreter of the script is missing
 	}
+	return ExitCannotExec
 }
 
 var opts struct {
-	Parent string     `short:"P" long:"parent" value-name:"PARENT" default:"/" description:"Parent hierarchy that should be inherited"`
-	Uid    string     `short:"u" long:"uid" value-name:"UID_OR_USERNAME" description:"User ID to create cgroup hierarchy/execute the program"`
-	user   *user.User // Filled based on Uid
+	Parent            string        `short:"P" long:"parent" value-name:"PARENT" description:"Parent hierarchy that should be inherited, the cgroup cgrun is in for each subsystem by default (/ on cgroup v2)"`
+	ParentFromPid     int           `long:"parent-from-pid" value-name:"PID" description:"Use the cgroup the process PID is in as the parent for each subsystem, to constrain the program the same way as it. On cgroup v2 it fails unless PID is in the root cgroup, give --parent with the parent of its cgroup instead"`
+	Uid               string        `short:"u" long:"uid" value-name:"UID_OR_USERNAME" description:"User ID to create cgroup hierarchy/execute the program"`
+	user              *user.User    // Filled based on Uid
+	execCred          *helperSpec   // Filled based on Uid, User and Group
+	CgroupRoot        string        `long:"cgroup-root" value-name:"DIR" description:"Find subsystems as subdirectories of DIR (e.g. DIR/cpu), or DIR itself for cgroup v2, instead of reading /proc/mounts"`
+	V1                bool          `long:"v1" description:"Use cgroup v1 hierarchies only, ignoring the v2 one on hybrid systems"`
+	V2                bool          `long:"v2" description:"Use the cgroup v2 hierarchy only, ignoring v1 ones on hybrid systems"`
+	Config            string        `short:"c" long:"config" value-name:"FILE" description:"Read parameters from FILE, one subsys.param=value for each line"`
+	Name              string        `short:"n" long:"name" value-name:"NAME" description:"Name of the cgroup to create instead of the generated one, missing intermediate cgroups in NAME are created"`
+	OnConflict        string        `long:"on-conflict" choice:"fail" choice:"suffix" default:"fail" description:"What to do if the hierarchy of --name exists, suffix tries NAME-1, NAME-2 and so on until a free one is found"`
+	MaxPids           string        `long:"max-pids" value-name:"N" description:"Limit the number of processes to N, same as pids.max=N"`
+	CpuLimit          string        `long:"cpu-limit" value-name:"CPUS" description:"Limit the CPU time to CPUS cores (e.g. 0.5, 2), same as cpu.cfs_period_us=100000 cpu.cfs_quota_us=CPUS*100000"`
+	Cpu               []string      `long:"cpu" value-name:"PARAM=VALUE,..." description:"Same as cpu.PARAM=VALUE for each, can be repeated"`
+	Memory            []string      `long:"memory" value-name:"PARAM=VALUE,..." description:"Same as memory.PARAM=VALUE for each, can be repeated"`
+	Blkio             []string      `long:"blkio" value-name:"PARAM=VALUE,..." description:"Same as blkio.PARAM=VALUE for each, can be repeated"`
+	DirMode           string        `long:"dir-mode" value-name:"MODE" description:"Permission of cgroups created in octal, regardless of umask" default-mask:"0750"`
+	IgnoreUnsupported bool          `long:"ignore-unsupported" description:"Skip parameters the kernel doesn't have with a warning instead of failing"`
+	NoInherit         bool          `long:"no-inherit" description:"Don't copy cpuset.cpus and cpuset.mems from the parent, they have to be given"`
+	BorrowRT          bool          `long:"borrow-rt" description:"Raise cpu.rt_runtime_us of ancestors not having enough RT bandwidth for cpu.rt_runtime_us given, they're restored on exit"`
+	MaxSiblings       int           `long:"max-siblings" value-name:"N" description:"Refuse to create the hierarchy if its parent cgroup already has N or more children, to cap concurrent jobs under a shared parent"`
+	NotifyOnRelease   bool          `long:"notify-on-release" description:"Set notify_on_release of the hierarchy so that the release agent runs once it becomes empty, it's cleared by default even if the parent has it (cgroup v1 only)"`
+	Keep              bool          `short:"k" long:"keep" description:"Don't remove the cgroup hierarchy after the program exits"`
+	Stats             bool          `short:"s" long:"stats" description:"Print resource usage statistics of the hierarchy on exit"`
+	EventLog          string        `long:"event-log" value-name:"PATH" description:"Append a timestamped line of memory.failcnt, throttling counts of cpu.stat and pids.current of the hierarchy to PATH every second until the processes exit"`
+	WatchThrottle     bool          `long:"watch-throttle" description:"Print a message each time the processes get throttled by the CPU quota, and when they're no longer, until they exit"`
+	DrainTimeout      time.Duration `long:"drain-timeout" value-name:"DURATION" description:"Wait up to DURATION for processes left in the hierarchy, e.g. daemons, to exit before removing it"`
+	KillOnCleanup     bool          `long:"kill-on-cleanup" description:"Kill processes left in the hierarchy with SIGKILL before removing it, after --drain-timeout if given"`
+	StrictCleanup     bool          `long:"strict-cleanup" description:"Exit with 7 and print paths left if the hierarchy can't be removed after the program exits, instead of the program's exit status"`
+	Cleanup           string        `long:"cleanup" value-name:"NAME" description:"Remove the hierarchy NAME left by --keep, then exit"`
+	Label             []string      `long:"label" value-name:"KEY=VALUE" description:"Attach the label to the hierarchy, which is shown by --list, can be repeated"`
+	StateDir          string        `long:"state-dir" value-name:"DIR" default:"/run/cgrun" description:"Directory to save labels of hierarchies"`
+	Show              string        `long:"show" value-name:"NAME" description:"Print current parameters of the hierarchy NAME in subsys.param=value form, then exit"`
+	List              bool          `short:"l" long:"list" description:"List available subsystems and their mount points, then exit"`
+	Check             bool          `long:"check" description:"Check that cgrun works on this system by creating and removing a scratch hierarchy under --parent for each subsystem, exits with 1 if anything fails"`
+	DryRun            bool          `long:"dry-run" description:"Print what would be done to setup the hierarchy and exit without doing it"`
+	PrintPaths        bool          `long:"print-paths" description:"Print directories of the hierarchy, one for each mount point, and exit without creating it. Give --name to get the ones a later run uses"`
+	Json              bool          `short:"j" long:"json" description:"Print the hierarchy as JSON instead of its name to stderr"`
+	StatusFd          int           `long:"status-fd" value-name:"FD" description:"Print the JSON of --json to FD instead of stderr, implies --json"`
+	NameFile          string        `long:"name-file" value-name:"FILE" description:"Write the hierarchy name to FILE once it's created"`
+	PreExec           string        `long:"pre-exec" value-name:"COMMAND" description:"Shell command run in the hierarchy as the user of the program before it, the program isn't run if it fails"`
+	Chdir             string        `long:"chdir" value-name:"DIR" description:"Change the working directory of the program to DIR, which relative paths of the program and --pre-exec are resolved against"`
+	Path              string        `long:"path" value-name:"PATH" description:"Look up the program in PATH instead of $PATH, which is set to the program as well. Relative entries are resolved against the working directory of the program"`
+	InheritEnv        string        `long:"inherit-env" choice:"true" choice:"false" default:"true" description:"Whether the program inherits the environment of cgrun, with false it starts from an empty one having only --keep-env and --env. The program is looked up in PATH of its environment, /bin:/usr/bin if none"`
+	KeepEnv           []string      `long:"keep-env" value-name:"KEY" description:"Pass the environment variable KEY of cgrun to the program with --inherit-env=false, can be repeated"`
+	Env               []string      `long:"env" value-name:"KEY=VALUE" description:"Set the environment variable of the program, can be repeated"`
+	Quiet             bool          `short:"q" long:"quiet" description:"Don't print the hierarchy name and other non-error messages to stderr"`
+	Verbose           bool          `short:"v" long:"verbose" description:"Print what's being done to stderr"`
+
+	// For exec mode
+	Shell          string        `long:"shell" value-name:"COMMAND" description:"Run COMMAND through $SHELL -c (or /bin/sh) instead of the program"`
+	Into           []string      `long:"into" value-name:"PATH" description:"Run the program in the existing cgroup at PATH instead of creating one, can be repeated for multiple subsystems"`
+	Timeout        time.Duration `short:"t" long:"timeout" value-name:"DURATION" description:"Terminate the program and the rest of processes in the hierarchy if it doesn't exit within DURATION (e.g. 30s)"`
+	ForwardSignals bool          `short:"F" long:"forward-signals" description:"Forward SIGINT/SIGTERM received by cgrun to the program"`
+	User           string        `long:"user" value-name:"UID_OR_USERNAME" description:"User to execute the program as, overrides --uid for the program only"`
+	Group          string        `long:"group" value-name:"GID_OR_GROUPNAME" description:"Group to execute the program as instead of the primary group of the user"`
+	Setpgid        bool          `long:"setpgid" description:"Run the program in a new process group which --forward-signals signals as a whole. The program can't read from the terminal"`
 
 	// For attach mode
-	Pid  *int `short:"p" long:"pid" value-name:"PID" description:"The target pid to attach volatile cgroup"`
-	Tree bool `short:"T" long:"tree" description:"When used with -p option, decide whether attach for whole process tree or not"`
+	Pid          []int  `short:"p" long:"pid" value-name:"PID" description:"The target pid to attach volatile cgroup, can be repeated to attach multiple processes"`
+	Thread       bool   `long:"thread" description:"Move only the thread of each pid given by --pid, which can be a thread id, rather than all threads of the process (cgroup v1 only)"`
+	Tree         bool   `short:"T" long:"tree" description:"When used with -p option, decide whether attach for whole process tree or not"`
+	MaxTreeDepth int    `long:"max-tree-depth" value-name:"N" description:"Attach descendants only up to N generations below the process with --tree. Ones forked later by attached processes are in the hierarchy regardless"`
+	WaitMode     string `long:"wait-mode" choice:"block" choice:"nowait" default:"block" description:"Whether to wait for the processes to exit, nowait implies --keep"`
+	FollowExec   bool   `long:"follow-exec" description:"Keep attaching processes newly forked in the tree until the processes exit, implies --tree. Best-effort as it polls /proc every second"`
+	MoveBack     bool   `long:"move-back" description:"Move the processes back to their original cgroups when cgrun exits so that the hierarchy can be removed"`
+	AttachSelf   bool   `long:"attach-self" description:"Attach the parent process, e.g. the shell cgrun is run from, and exit keeping the hierarchy. Use -p $$ --wait-mode nowait instead under sudo"`
+	Freeze       bool   `long:"freeze" description:"Freeze the processes given by -p until they exit or cgrun is interrupted, same as freezer.state=FROZEN, implies --move-back"`
 }
 
 func main() {
 	if os.Args[0] == HelperInitProgName {
-		helperMain()
-		os.Exit(1) // Never returns on success
+		os.Exit(helperMain()) // Never returns on success
 	}
 	os.Exit(initialMain())
 }
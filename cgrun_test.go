@@ -0,0 +1,137 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kawamuray/cgrun/cgroup"
+	"github.com/kawamuray/cgrun/cgroup/cgrouptest"
+)
+
+// useFakeFS replaces cgroup.FS with a fake one having the files until the
+// test ends.
+func useFakeFS(t *testing.T, files map[string]string) *cgrouptest.FS {
+	fs := cgrouptest.New(t, files)
+	cgroup.FS = fs
+	cgroup.Reset()
+	t.Cleanup(func() {
+		cgroup.FS = cgroup.OSFileSystem{}
+		cgroup.Reset()
+	})
+	return fs
+}
+
+// A process tree of 100 -> 200 -> 300 -> 10, along with unrelated 1 and 400
+var procFiles = map[string]string{
+	"/proc/cgroups":  "#subsys_name\thierarchy\tnum_cgroups\tenabled\ncpu\t2\t1\t1\n",
+	"/proc/mounts":   "cgroup /sys/fs/cgroup/cpu cgroup rw,cpu 0 0\n",
+	"/proc/1/stat":   "1 (init) S 0 1 1 0 -1\n",
+	"/proc/10/stat":  "10 (sleep) S 300 10 1 0 -1\n",
+	"/proc/100/stat": "100 (sh) S 1 100 1 0 -1\n",
+	"/proc/200/stat": "200 (odd) S (name) R 100 100 1 0 -1\n",
+	"/proc/300/stat": "300 (worker) S 200 100 1 0 -1\n",
+	"/proc/400/stat": "400 (daemon) S 1 400 400 0 -1\n",
+
+	"/sys/fs/cgroup/cpu/cgroup.procs": "1\n",
+}
+
+func TestReadPpid(t *testing.T) {
+	useFakeFS(t, procFiles)
+	for pid, want := range map[string]string{"100": "1", "200": "100", "10": "300"} {
+		got, err := readPpid(pid)
+		if err != nil {
+			t.Errorf("readPpid(%s) error = %v", pid, err)
+		} else if got != want {
+			t.Errorf("readPpid(%s) = %s, want %s", pid, got, want)
+		}
+	}
+	if _, err := readPpid("12345"); !exited(err) {
+		t.Errorf("readPpid of missing pid error = %v, want one of exited process", err)
+	}
+}
+
+func TestCollectTree(t *testing.T) {
+	for _, tc := range []struct {
+		maxDepth int
+		want     map[string]int
+	}{
+		// 10 is found only by the second pass as it's listed before its parent
+		{0, map[string]int{"100": 0, "200": 1, "300": 2, "10": 3}},
+		{1, map[string]int{"100": 0, "200": 1}},
+	} {
+		useFakeFS(t, procFiles)
+		spec := cgroup.Spec{Parent: "/", Params: map[string]map[string]string{"cpu": {}}}
+		h, err := spec.Setup()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts.Tree, opts.MaxTreeDepth = true, tc.maxDepth
+		tree := make(map[string]int)
+		err = collectPids(h, 100, tree)
+		opts.Tree, opts.MaxTreeDepth = false, 0
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tree, tc.want) {
+			t.Errorf("tree with --max-tree-depth %d = %v, want %v", tc.maxDepth, tree, tc.want)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args               []string
+		cgrunArgs, program []string
+		hasSep             bool
+	}{
+		{[]string{"-v", "cpu.shares=1"}, []string{"-v", "cpu.shares=1"}, nil, false},
+		{[]string{"cpu.shares=1", "--", "ls", "--", "-l"}, []string{"cpu.shares=1"}, []string{"ls", "--", "-l"}, true},
+		{[]string{"--", "-v"}, []string{}, []string{"-v"}, true},
+	} {
+		cgrunArgs, program, hasSep := splitArgs(tc.args)
+		if !reflect.DeepEqual(cgrunArgs, tc.cgrunArgs) || !reflect.DeepEqual(program, tc.program) || hasSep != tc.hasSep {
+			t.Errorf("splitArgs(%q) = %q, %q, %v", tc.args, cgrunArgs, program, hasSep)
+		}
+	}
+}
+
+func TestLookupProgram(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bin", "foobar"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", os.Getenv("PATH"))
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		filepath.Join(dir, "bin"): filepath.Join(dir, "bin", "foobar"),
+		"/nonexistent:bin":        "bin/foobar",
+	} {
+		got, err := lookupProgram("foobar", []string{"HOME=/", "PATH=" + path})
+		if err != nil {
+			t.Errorf("lookupProgram with PATH=%s error = %v", path, err)
+		} else if got != want {
+			t.Errorf("lookupProgram with PATH=%s = %s, want %s", path, got, want)
+		}
+	}
+	if _, err := lookupProgram("foobar", []string{"HOME=/"}); err == nil {
+		t.Error("lookupProgram found the program without PATH in the environment")
+	}
+}
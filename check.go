@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/kawamuray/cgrun/cgroup"
+)
+
+// checker prints the result of each check of --check.
+type checker struct {
+	w      *tabwriter.Writer
+	failed bool
+}
+
+func (c *checker) report(what string, err error) {
+	if err != nil {
+		fmt.Fprintf(c.w, "FAIL\t%s\t%s\n", what, err)
+		c.failed = true
+		return
+	}
+	fmt.Fprintf(c.w, "PASS\t%s\n", what)
+}
+
+// checkEnvironment verifies that cgrun can work on this system, by creating
+// and removing a scratch hierarchy under the parent for each subsystem
+// mounted. It returns false if any of the checks failed.
+func checkEnvironment() bool {
+	c := &checker{w: tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)}
+	defer c.w.Flush()
+
+	for _, path := range []string{"/proc/cgroups", "/proc/mounts"} {
+		_, err := ioutil.ReadFile(path)
+		c.report(path+" is readable", err)
+	}
+	if err := cgroup.Init(); err != nil {
+		c.report("cgroup is available", err)
+		return false
+	}
+
+	var subsyses []string
+	for subsys, mountPoint := range cgroup.MountPoints() {
+		if mountPoint != "" {
+			subsyses = append(subsyses, subsys)
+		}
+	}
+	sort.Strings(subsyses)
+
+	// Nothing is left on a signal either, a scratch hierarchy being set up
+	// is rolled back and one created is removed
+	var (
+		mu      sync.Mutex
+		scratch *cgroup.Hierarchy
+		cancel  = make(chan struct{})
+	)
+	setupSignalHandler(func() {
+		close(cancel)
+		mu.Lock()
+		if scratch != nil {
+			scratch.Cleanup()
+		}
+	})
+
+	version := "v1"
+	if cgroup.V2() {
+		version = "v2"
+	}
+	var err error
+	if len(subsyses) == 0 {
+		err = fmt.Errorf("no subsystem is mounted")
+	}
+	c.report(fmt.Sprintf("cgroup %s with %d subsystems mounted", version, len(subsyses)), err)
+
+	for _, subsys := range subsyses {
+		spec := cgroup.Spec{
+			Parent:    opts.Parent,
+			ParentPid: opts.ParentFromPid,
+			Params:    map[string]map[string]string{subsys: {}},
+			Cancel:    cancel,
+			// Not to leave cgroup.subtree_control of the parent changed
+			RestoreControllers: true,
+		}
+		mu.Lock()
+		h, err := spec.Setup()
+		if err == nil {
+			scratch = h
+			debugf("created scratch hierarchy %s", h.Path(subsys))
+			err = h.Cleanup()
+			scratch = nil
+		}
+		mu.Unlock()
+		if errors.Is(err, cgroup.ErrCanceled) {
+			select {} // The signal handler exits
+		}
+		c.report(fmt.Sprintf("%s can be created and removed under %s", subsys, cgroup.MountPoints()[subsys]), err)
+	}
+	return !c.failed
+}
@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kawamuray/cgrun/cgroup"
+)
+
+// Interval to sample counters for --event-log
+const eventLogInterval = time.Second
+
+// A counter sampled for --event-log, the whole content of the file if key is
+// empty, otherwise the value of key in the flat keyed file
+type eventCounter struct {
+	file string
+	key  string
+}
+
+var eventCounters = map[string][]eventCounter{
+	"cpu":    {{"stat", "nr_throttled"}, {"stat", "throttled_time"}},
+	"memory": {{"usage_in_bytes", ""}, {"failcnt", ""}},
+	"pids":   {{"current", ""}},
+}
+
+var eventCountersV2 = map[string][]eventCounter{
+	"cpu":    {{"stat", "nr_throttled"}, {"stat", "throttled_usec"}},
+	"memory": {{"current", ""}, {"events", "max"}, {"events", "oom_kill"}},
+	"pids":   {{"current", ""}},
+}
+
+// eventLogger appends a timestamped line of counters of the hierarchy to the
+// log periodically while the workload runs.
+type eventLogger struct {
+	h    *cgroup.Hierarchy
+	log  *os.File
+	quit chan struct{}
+	done chan struct{}
+}
+
+func startEventLog(path string, h *cgroup.Hierarchy) (*eventLogger, error) {
+	log, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &eventLogger{h: h, log: log, quit: make(chan struct{}), done: make(chan struct{})}
+	go l.loop()
+	return l, nil
+}
+
+func (l *eventLogger) loop() {
+	defer close(l.done)
+	ticker := time.NewTicker(eventLogInterval)
+	defer ticker.Stop()
+	for {
+		l.sample()
+		select {
+		case <-l.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *eventLogger) sample() {
+	counters := eventCounters
+	if cgroup.V2() {
+		counters = eventCountersV2
+	}
+	var subsyses []string
+	for subsys, _ := range l.h.Params {
+		subsyses = append(subsyses, subsys)
+	}
+	sort.Strings(subsyses)
+
+	fields := []string{time.Now().Format(time.RFC3339Nano)}
+	for _, subsys := range subsyses {
+		for _, c := range counters[subsys] {
+			path := filepath.Join(l.h.Path(subsys), subsys+"."+c.file)
+			name := subsys + "." + c.file
+			if c.key == "" {
+				buf, err := ioutil.ReadFile(path)
+				if err != nil {
+					continue
+				}
+				fields = append(fields, fmt.Sprintf("%s=%s", name, strings.TrimSpace(string(buf))))
+				continue
+			}
+			if value := readStatValue(path, c.key); value >= 0 {
+				fields = append(fields, fmt.Sprintf("%s.%s=%d", name, c.key, value))
+			}
+		}
+	}
+	if _, err := fmt.Fprintln(l.log, strings.Join(fields, " ")); err != nil {
+		debugf("failed to write event log: %s", err)
+	}
+}
+
+// stop takes the last sample and closes the log. This has to be called
+// before the cgroup is removed.
+func (l *eventLogger) stop() {
+	close(l.quit)
+	<-l.done
+	l.sample()
+	if err := l.log.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write event log: %s\n", err)
+	}
+}
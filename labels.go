@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kawamuray/cgrun/cgroup"
+)
+
+// Labels of a hierarchy saved in the state directory. cgroupfs has no place
+// to store them in the hierarchy itself.
+type labelState struct {
+	Name   string            `json:"name"`
+	Paths  []string          `json:"paths"`
+	Labels map[string]string `json:"labels"`
+}
+
+// parseLabels parses KEY=VALUE labels given by --label.
+func parseLabels(args []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, arg := range args {
+		sep := strings.Index(arg, "=")
+		if sep <= 0 {
+			return nil, fmt.Errorf("incorrect label: '%s', must be KEY=VALUE", arg)
+		}
+		labels[arg[:sep]] = arg[sep+1:]
+	}
+	return labels, nil
+}
+
+func labelStatePath(name string) string {
+	return filepath.Join(opts.StateDir, name+".json")
+}
+
+// saveLabels records labels of the hierarchy in the state directory.
+func saveLabels(h *cgroup.Hierarchy, labels map[string]string) error {
+	paths, err := h.Paths()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(labelState{Name: h.Name, Paths: paths, Labels: labels})
+	if err != nil {
+		return err
+	}
+	path := labelStatePath(h.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	debugf("saving labels to %s", path)
+	return ioutil.WriteFile(path, buf, 0644)
+}
+
+// removeLabels removes labels of the hierarchy if any.
+func removeLabels(name string) {
+	path := labelStatePath(name)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "failed to remove labels of '%s': %s\n", name, err)
+	}
+}
+
+// readLabels returns labels of hierarchies which still exist, sorted by name.
+// Ones removed without cgrun are left in the state directory but skipped.
+func readLabels() ([]labelState, error) {
+	var states []labelState
+	err := filepath.Walk(opts.StateDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(path, ".json") {
+			return err
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var state labelState
+		if err := json.Unmarshal(buf, &state); err != nil {
+			return fmt.Errorf("malformed label state %s: %s", path, err)
+		}
+		for _, hirPath := range state.Paths {
+			if _, err := os.Stat(hirPath); err == nil {
+				states = append(states, state)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states, nil
+}
+
+// listLabels prints labeled hierarchies, nothing if there's none.
+func listLabels() error {
+	states, err := readLabels()
+	if err != nil || len(states) == 0 {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w)
+	for _, state := range states {
+		var labels []string
+		for key, value := range state.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+		fmt.Fprintf(w, "%s\t%s\n", state.Name, strings.Join(labels, ","))
+	}
+	return w.Flush()
+}
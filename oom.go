@@ -0,0 +1,112 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kawamuray/cgrun/cgroup"
+	"golang.org/x/sys/unix"
+)
+
+// oomWatcher reports OOM events which occurred in the memory cgroup so that
+// it becomes clear why the workload has died.
+type oomWatcher struct {
+	hirPath  string
+	event    *os.File // eventfd registered to cgroup.event_control, v1 only
+	done     chan struct{}
+	occurred atomic.Bool
+}
+
+func watchOOM(hirPath string) (*oomWatcher, error) {
+	w := &oomWatcher{hirPath: hirPath}
+	if cgroup.V2() {
+		// There's no event_control in v2, memory.events is checked on stop
+		return w, nil
+	}
+
+	ctl, err := os.Open(filepath.Join(hirPath, "memory.oom_control"))
+	if err != nil {
+		return nil, err
+	}
+	defer ctl.Close() // Not needed once registered
+
+	// Non-blocking so that os.File polls it and Close() can interrupt Read()
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w.event = os.NewFile(uintptr(efd), "oom-eventfd")
+	path := filepath.Join(hirPath, "cgroup.event_control")
+	debugf("registering OOM eventfd to %s", path)
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%d %d", efd, ctl.Fd())), 0); err != nil {
+		w.event.Close()
+		return nil, err
+	}
+
+	w.done = make(chan struct{})
+	go w.loop()
+	return w, nil
+}
+
+func (w *oomWatcher) loop() {
+	defer close(w.done)
+	buf := make([]byte, 8)
+	for {
+		if _, err := w.event.Read(buf); err != nil {
+			return
+		}
+		// The event is notified on removal of the cgroup as well
+		if _, err := os.Stat(w.hirPath); err != nil {
+			return
+		}
+		if !w.occurred.Swap(true) {
+			fmt.Fprintf(os.Stderr, "cgrun: out of memory in '%s'\n", w.hirPath)
+		}
+	}
+}
+
+// stop stops watching and reports processes killed by the OOM killer. This
+// has to be called before the cgroup is removed.
+func (w *oomWatcher) stop() {
+	if w.event != nil {
+		w.event.Close()
+		<-w.done
+	}
+
+	file := "memory.oom_control"
+	if cgroup.V2() {
+		file = "memory.events"
+	}
+	// oom_kill is missing in older kernels
+	if kills := readStatValue(filepath.Join(w.hirPath, file), "oom_kill"); kills > 0 {
+		fmt.Fprintf(os.Stderr, "cgrun: %d process(es) killed by OOM killer in '%s'\n", kills, w.hirPath)
+	} else if w.occurred.Load() {
+		fmt.Fprintf(os.Stderr, "cgrun: the program ran out of memory in '%s'\n", w.hirPath)
+	}
+}
+
+// readStatValue reads the value of key from a flat keyed file like
+// memory.events. -1 is returned if it's not available.
+func readStatValue(path, key string) int64 {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 && f[0] == key {
+			if n, err := strconv.ParseInt(f[1], 10, 64); err == nil {
+				return n
+			}
+		}
+	}
+	return -1
+}
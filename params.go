@@ -0,0 +1,528 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/kawamuray/cgrun/cgroup"
+	"golang.org/x/sys/unix"
+)
+
+// parseParam splits an argument like cpu.shares=1024 into its subsystem,
+// parameter name and value. A value like @/path/to/file is read from the file.
+func parseParam(arg string) (subsys, param, value string, err error) {
+	sep := strings.Index(arg, "=")
+	if sep == -1 {
+		return "", "", "", fmt.Errorf("incorrect parameter: '%s'", arg)
+	}
+	// cpu.shares=1024 -> cpu.shares(name), 1024(value)
+	name := arg[:sep]
+	value = arg[sep+1:]
+	sep = strings.Index(name, ".")
+	if sep == -1 {
+		return "", "", "", fmt.Errorf("incorrect parameter name: '%s'", name)
+	}
+	// cpu.shares -> cpu(subsys), shares
+	subsys = name[:sep]
+	param = name[sep+1:]
+
+	if strings.HasPrefix(value, "@") {
+		buf, err := ioutil.ReadFile(value[1:])
+		if err != nil {
+			return "", "", "", fmt.Errorf("can't read the value of %s from %s: %s", name, value[1:], err)
+		}
+		value = strings.TrimRight(string(buf), "\n")
+		if cgroup.IsAppendParam(subsys, param) {
+			// A rule per line
+			var rules []string
+			for _, rule := range strings.Split(value, "\n") {
+				if rule, err = normalizeValue(subsys, param, rule); err != nil {
+					return "", "", "", err
+				}
+				rules = append(rules, rule)
+			}
+			return subsys, param, strings.Join(rules, "\n"), nil
+		}
+	}
+	value, err = normalizeValue(subsys, param, value)
+	if err != nil {
+		return "", "", "", err
+	}
+	return subsys, param, value, nil
+}
+
+func setParam(params map[string]map[string]string, subsys, param, value string) {
+	if _, ok := params[subsys]; !ok {
+		params[subsys] = make(map[string]string)
+	}
+	if prev, ok := params[subsys][param]; ok && cgroup.IsAppendParam(subsys, param) {
+		// Repeated rules are all written
+		value = prev + "\n" + value
+	}
+	params[subsys][param] = value
+}
+
+// parseGroupedParams parses parameters of the subsystem given like
+// shares=512,cfs_quota_us=50000 for cpu.
+func parseGroupedParams(subsys, arg string, params map[string]map[string]string) error {
+	for _, entry := range strings.Split(arg, ",") {
+		subsys, param, value, err := parseParam(subsys + "." + entry)
+		if err != nil {
+			return err
+		}
+		setParam(params, subsys, param, value)
+	}
+	return nil
+}
+
+// readConfigFile reads parameters from a file which has a subsys.param=value
+// entry for each line. Empty lines and text following '#' are ignored.
+func readConfigFile(path string, params map[string]map[string]string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if sep := strings.Index(line, "#"); sep != -1 {
+			line = line[:sep]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		subsys, param, value, err := parseParam(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineno, err)
+		}
+		setParam(params, subsys, param, value)
+	}
+	return scanner.Err()
+}
+
+// Prefix of environment variables which specify parameters
+const paramEnvPrefix = "CGRUN_PARAM_"
+
+// Subsystems having '_' in their name which can't be told from the separator
+var underscoredSubsystems = []string{"net_cls", "net_prio", "perf_event"}
+
+// readEnvParams reads parameters from environment variables like
+// CGRUN_PARAM_CPU_SHARES=512. Since '.' can't be used in a variable name, "__"
+// stands for it, e.g. CGRUN_PARAM_MEMORY_MEMSW__LIMIT_IN_BYTES.
+func readEnvParams(environ []string, params map[string]map[string]string) error {
+	for _, env := range environ {
+		if !strings.HasPrefix(env, paramEnvPrefix) {
+			continue
+		}
+		sep := strings.Index(env, "=")
+		if sep == -1 {
+			continue
+		}
+		name := strings.ToLower(env[len(paramEnvPrefix):sep])
+		value := env[sep+1:]
+
+		subsys := ""
+		for _, s := range underscoredSubsystems {
+			if strings.HasPrefix(name, s+"_") {
+				subsys = s
+				break
+			}
+		}
+		if subsys == "" {
+			if sep := strings.Index(name, "_"); sep > 0 {
+				subsys = name[:sep]
+			}
+		}
+		if subsys == "" || len(name) == len(subsys)+1 {
+			return fmt.Errorf("incorrect parameter variable: '%s'", env[:sep])
+		}
+		param := strings.Replace(name[len(subsys)+1:], "__", ".", -1)
+		if subsys == "hugetlb" {
+			// Page size is in upper case, e.g. hugetlb.2MB.limit_in_bytes
+			if sep := strings.Index(param, "."); sep != -1 {
+				param = strings.ToUpper(param[:sep]) + param[sep:]
+			}
+		}
+
+		subsys, param, value, err := parseParam(subsys + "." + param + "=" + value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", env[:sep], err)
+		}
+		setParam(params, subsys, param, value)
+	}
+	return nil
+}
+
+// normalizeValue converts a user friendly value into the form that the
+// kernel accepts for the parameter.
+func normalizeValue(subsys, param, value string) (string, error) {
+	switch subsys + "." + param {
+	case "net_cls.classid":
+		return normalizeClassid(value)
+	case "blkio.throttle.read_bps_device", "blkio.throttle.write_bps_device":
+		return normalizeDeviceValue(subsys+"."+param, value, true)
+	case "blkio.throttle.read_iops_device", "blkio.throttle.write_iops_device", "blkio.weight_device":
+		return normalizeDeviceValue(subsys+"."+param, value, false)
+	case "io.max":
+		return normalizeIoMax(value)
+	case "pids.max":
+		if n, err := strconv.ParseUint(value, 10, 64); value != "max" && (err != nil || n == 0) {
+			return "", fmt.Errorf("invalid value for pids.max: '%s', must be a positive integer or 'max'", value)
+		}
+		return value, nil
+	case "memory.swappiness":
+		if n, err := strconv.ParseUint(value, 10, 64); err != nil || n > 100 {
+			return "", fmt.Errorf("invalid value for memory.swappiness: '%s', must be between 0 and 100", value)
+		}
+		return value, nil
+	case "net_prio.ifpriomap":
+		f := strings.Fields(value)
+		if len(f) != 2 {
+			return "", fmt.Errorf("invalid value for net_prio.ifpriomap: '%s', must be 'IFNAME PRIORITY'", value)
+		}
+		if _, err := strconv.ParseUint(f[1], 10, 32); err != nil {
+			return "", fmt.Errorf("invalid priority for net_prio.ifpriomap: '%s'", f[1])
+		}
+		return f[0] + " " + f[1], nil
+	case "cpu.uclamp.min", "cpu.uclamp.max":
+		// A percentage with up to two decimal digits
+		if value != "max" && !uclampPattern.MatchString(value) {
+			return "", fmt.Errorf("invalid value for %s.%s: '%s', must be a percentage like 12.5 or 'max'", subsys, param, value)
+		}
+		if n, _ := strconv.ParseFloat(value, 64); n > 100 {
+			return "", fmt.Errorf("invalid value for %s.%s: '%s', must be between 0 and 100", subsys, param, value)
+		}
+		return value, nil
+	case "cpuset.cpu_exclusive", "cpuset.mem_exclusive", "cpuset.mem_hardwall", "cpuset.memory_migrate",
+		"cpuset.memory_spread_page", "cpuset.memory_spread_slab", "cpuset.sched_load_balance":
+		switch value {
+		case "1", "true":
+			return "1", nil
+		case "0", "false":
+			return "0", nil
+		}
+		return "", fmt.Errorf("invalid value for %s.%s: '%s', must be true, false, 1 or 0", subsys, param, value)
+	case "devices.allow", "devices.deny":
+		rule := strings.Join(strings.Fields(value), " ")
+		if !deviceRulePattern.MatchString(rule) {
+			return "", fmt.Errorf("invalid rule for %s.%s: '%s', must be 'a' or 'TYPE MAJOR:MINOR ACCESS' like 'c 1:3 rwm'", subsys, param, value)
+		}
+		return rule, nil
+	}
+
+	if subsys == "hugetlb" {
+		if err := checkHugePageSize(param); err != nil {
+			return "", err
+		}
+	}
+	if subsys == "memory" && strings.HasSuffix(value, "%") && isByteParam(subsys, param) {
+		bytes, err := expandMemoryPercentage(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid value for %s.%s: %s", subsys, param, err)
+		}
+		return bytes, nil
+	}
+	if isByteParam(subsys, param) {
+		bytes, err := expandSize(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid value for %s.%s: %s", subsys, param, err)
+		}
+		return bytes, nil
+	}
+	return value, nil
+}
+
+var uclampPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]{1,2})?$`)
+
+// TYPE is one of a(ll), c(har) or b(lock), * in MAJOR:MINOR matches all
+var deviceRulePattern = regexp.MustCompile(`^(a|[abc] ([0-9]+|\*):([0-9]+|\*) [rwm]+)$`)
+
+// Parameters which take a size in bytes, e.g. memory.limit_in_bytes or
+// memory.max and memory.swap.max in v2.
+func isByteParam(subsys, param string) bool {
+	if strings.HasSuffix(param, "_in_bytes") {
+		return true
+	}
+	if subsys != "memory" && subsys != "hugetlb" {
+		return false // e.g. pids.max and cpu.max aren't sizes
+	}
+	return param == "max" || strings.HasSuffix(param, ".max")
+}
+
+// Directory listing the huge page sizes supported by the system
+const hugePagesDir = "/sys/kernel/mm/hugepages"
+
+// checkHugePageSize makes sure that the page size in the hugetlb parameter
+// like 2MB.limit_in_bytes is available on the system.
+func checkHugePageSize(param string) error {
+	size := param
+	if dot := strings.Index(param, "."); dot != -1 {
+		size = param[:dot]
+	}
+	sizes, err := hugePageSizes()
+	if err != nil {
+		return fmt.Errorf("huge pages not available: %s", err)
+	}
+	for _, s := range sizes {
+		if s == size {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported huge page size '%s' in hugetlb.%s, available: %s", size, param, strings.Join(sizes, ", "))
+}
+
+// hugePageSizes returns the available huge page sizes in the form used in the
+// hugetlb parameter names, e.g. 2MB for hugepages-2048kB.
+func hugePageSizes() ([]string, error) {
+	dp, err := os.Open(hugePagesDir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := dp.Readdirnames(-1)
+	dp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var kbs []uint64
+	for _, name := range names {
+		kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "hugepages-"), "kB"), 10, 64)
+		if err == nil {
+			kbs = append(kbs, kb)
+		}
+	}
+	sort.Slice(kbs, func(i, j int) bool { return kbs[i] < kbs[j] })
+
+	var sizes []string
+	for _, kb := range kbs {
+		// Same format as the kernel names the hugetlb control files
+		switch {
+		case kb >= 1<<20:
+			sizes = append(sizes, fmt.Sprintf("%dGB", kb>>20))
+		case kb >= 1<<10:
+			sizes = append(sizes, fmt.Sprintf("%dMB", kb>>10))
+		default:
+			sizes = append(sizes, fmt.Sprintf("%dKB", kb))
+		}
+	}
+	return sizes, nil
+}
+
+var sizePattern = regexp.MustCompile(`^([0-9]+)([KMG])(i?)$`)
+
+var sizeUnits = map[string]uint64{
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+}
+
+// expandSize expands sizes like 512M into raw bytes. Both of K and Ki are
+// treated as 1024 as like as the kernel does. Values without a suffix (like
+// -1 or max) are returned as is.
+func expandSize(value string) (string, error) {
+	m := sizePattern.FindStringSubmatch(value)
+	if m == nil {
+		if len(value) > 0 && value[0] >= '0' && value[0] <= '9' {
+			if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+				return "", fmt.Errorf("malformed size '%s'", value)
+			}
+		}
+		return value, nil
+	}
+	n, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed size '%s'", value)
+	}
+	unit := sizeUnits[m[2]]
+	if n > (1<<64-1)/unit {
+		return "", fmt.Errorf("size '%s' is too large", value)
+	}
+	return strconv.FormatUint(n*unit, 10), nil
+}
+
+// expandMemoryPercentage expands a percentage of the total memory like 25%
+// into bytes, rounded to the nearest page size.
+func expandMemoryPercentage(value string) (string, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return "", fmt.Errorf("malformed percentage '%s', must be between 0%% and 100%%", value)
+	}
+	total, err := memTotal()
+	if err != nil {
+		return "", fmt.Errorf("can't find out the total memory: %s", err)
+	}
+	pageSize := float64(os.Getpagesize())
+	pages := math.Round(float64(total) * percent / 100 / pageSize)
+	return strconv.FormatUint(uint64(pages*pageSize), 10), nil
+}
+
+// memTotal returns MemTotal in /proc/meminfo in bytes.
+func memTotal() (uint64, error) {
+	fp, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		// MemTotal:       16318664 kB
+		f := strings.Fields(scanner.Text())
+		if len(f) == 3 && f[0] == "MemTotal:" && f[2] == "kB" {
+			kb, err := strconv.ParseUint(f[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("malformed MemTotal: '%s'", f[1])
+			}
+			return kb << 10, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+}
+
+// normalizeClassid accepts the classid of net_cls either as a number or in
+// the tc(8) style MAJOR:MINOR notation in hex, e.g. 10:1 for 0x100001.
+func normalizeClassid(value string) (string, error) {
+	sep := strings.Index(value, ":")
+	if sep == -1 {
+		if _, err := strconv.ParseUint(value, 0, 32); err != nil {
+			return "", fmt.Errorf("invalid value for net_cls.classid: '%s'", value)
+		}
+		return value, nil
+	}
+
+	major, err := strconv.ParseUint(strings.TrimPrefix(value[:sep], "0x"), 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid major of net_cls.classid: '%s'", value[:sep])
+	}
+	minor, err := strconv.ParseUint(strings.TrimPrefix(value[sep+1:], "0x"), 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid minor of net_cls.classid: '%s'", value[sep+1:])
+	}
+	return fmt.Sprintf("0x%x", major<<16|minor), nil
+}
+
+// cpuLimitPeriod is the cpu.cfs_period_us used for --cpu-limit, same as the
+// kernel default.
+const cpuLimitPeriod = 100000
+
+// minCfsQuota is the smallest cpu.cfs_quota_us the kernel accepts.
+const minCfsQuota = 1000
+
+// cpuLimitQuota converts the number of CPUs like 0.5 into cpu.cfs_quota_us
+// for the period of cpuLimitPeriod.
+func cpuLimitQuota(limit string) (string, error) {
+	cpus, err := strconv.ParseFloat(limit, 64)
+	if err != nil || cpus <= 0 || math.IsInf(cpus, 0) {
+		return "", fmt.Errorf("invalid cpu limit: '%s', must be a positive number of CPUs", limit)
+	}
+	quota := cpus * cpuLimitPeriod
+	if quota < minCfsQuota {
+		return "", fmt.Errorf("cpu limit '%s' is too small, must be at least %g", limit, float64(minCfsQuota)/cpuLimitPeriod)
+	}
+	if quota > math.MaxInt64 {
+		return "", fmt.Errorf("cpu limit '%s' is too large", limit)
+	}
+	return strconv.FormatInt(int64(quota), 10), nil
+}
+
+// normalizeDeviceValue converts a value like "/dev/sda 1M" for the per device
+// parameters into "8:0 1048576" which the kernel expects.
+func normalizeDeviceValue(name, value string, isSize bool) (string, error) {
+	f := strings.Fields(value)
+	if len(f) != 2 {
+		return "", fmt.Errorf("invalid value for %s: '%s', must be 'DEVICE VALUE'", name, value)
+	}
+
+	dev := f[0]
+	if strings.HasPrefix(dev, "/") {
+		var err error
+		if dev, err = resolveDevice(dev); err != nil {
+			return "", fmt.Errorf("invalid device for %s: %s", name, err)
+		}
+	}
+
+	val := f[1]
+	if isSize {
+		var err error
+		if val, err = expandSize(val); err != nil {
+			return "", fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+	}
+	return dev + " " + val, nil
+}
+
+// normalizeIoMax converts a value like "/dev/sdb rbps=1M wbps=2M" for v2
+// io.max into "8:16 rbps=1048576 wbps=2097152" which the kernel expects.
+func normalizeIoMax(value string) (string, error) {
+	f := strings.Fields(value)
+	if len(f) < 2 {
+		return "", fmt.Errorf("invalid value for io.max: '%s', must be 'DEVICE KEY=VALUE...'", value)
+	}
+
+	dev := f[0]
+	if strings.HasPrefix(dev, "/") {
+		var err error
+		if dev, err = resolveDevice(dev); err != nil {
+			return "", fmt.Errorf("invalid device for io.max: %s", err)
+		}
+	} else if !devNumberPattern.MatchString(dev) {
+		return "", fmt.Errorf("invalid device for io.max: '%s', must be a device file or MAJOR:MINOR", dev)
+	}
+
+	entries := []string{dev}
+	for _, entry := range f[1:] {
+		sep := strings.Index(entry, "=")
+		if sep == -1 {
+			return "", fmt.Errorf("invalid limit for io.max: '%s', must be KEY=VALUE", entry)
+		}
+		key, val := entry[:sep], entry[sep+1:]
+		switch {
+		case val == "max":
+		case key == "rbps" || key == "wbps":
+			bytes, err := expandSize(val)
+			if err != nil {
+				return "", fmt.Errorf("invalid value for io.max %s: %s", key, err)
+			}
+			val = bytes
+		case key == "riops" || key == "wiops":
+			if _, err := strconv.ParseUint(val, 10, 64); err != nil {
+				return "", fmt.Errorf("invalid value for io.max %s: '%s'", key, val)
+			}
+		default:
+			return "", fmt.Errorf("unknown limit for io.max: '%s', must be one of rbps, wbps, riops and wiops", key)
+		}
+		entries = append(entries, key+"="+val)
+	}
+	return strings.Join(entries, " "), nil
+}
+
+var devNumberPattern = regexp.MustCompile(`^[0-9]+:[0-9]+$`)
+
+// resolveDevice returns MAJOR:MINOR of the block device file.
+func resolveDevice(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return "", fmt.Errorf("'%s' is not a block device", path)
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))), nil
+}
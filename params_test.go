@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "testing"
+
+func TestExpandSize(t *testing.T) {
+	for value, want := range map[string]string{
+		"512M": "536870912",
+		"1Ki":  "1024",
+		"2G":   "2147483648",
+		"4096": "4096",
+		"-1":   "-1",
+		"max":  "max",
+	} {
+		got, err := expandSize(value)
+		if err != nil {
+			t.Errorf("expandSize(%q) error = %v", value, err)
+		} else if got != want {
+			t.Errorf("expandSize(%q) = %s, want %s", value, got, want)
+		}
+	}
+	for _, value := range []string{"1x", "1.5G", "99999999999G"} {
+		if _, err := expandSize(value); err == nil {
+			t.Errorf("expandSize(%q) succeeded", value)
+		}
+	}
+}
+
+func TestNormalizeClassid(t *testing.T) {
+	for value, want := range map[string]string{
+		"10:1":     "0x100001",
+		"0x10:0x1": "0x100001",
+		"ffff:0":   "0xffff0000",
+		"1048577":  "1048577",
+		"0x100001": "0x100001",
+	} {
+		got, err := normalizeClassid(value)
+		if err != nil {
+			t.Errorf("normalizeClassid(%q) error = %v", value, err)
+		} else if got != want {
+			t.Errorf("normalizeClassid(%q) = %s, want %s", value, got, want)
+		}
+	}
+	for _, value := range []string{"", "x", "10000:1", "1:g", "4294967296"} {
+		if _, err := normalizeClassid(value); err == nil {
+			t.Errorf("normalizeClassid(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kawamuray/cgrun/cgroup"
+)
+
+// Interval to check cpu.stat for --watch-throttle
+const throttleWatchInterval = time.Second
+
+// throttleWatcher reports when the workload gets throttled by the CFS quota
+// and when it's no longer, so that pauses can be correlated with them.
+type throttleWatcher struct {
+	path       string // cpu.stat
+	last       int64  // nr_throttled
+	lastTime   time.Duration
+	throttling bool
+	quit       chan struct{}
+	done       chan struct{}
+}
+
+func watchThrottle(hirPath string) *throttleWatcher {
+	w := &throttleWatcher{
+		path: filepath.Join(hirPath, "cpu.stat"),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	w.last, w.lastTime = w.read()
+	go w.loop()
+	return w
+}
+
+// read returns nr_throttled and the total time throttled, which is in
+// nanoseconds in v1 and microseconds in v2.
+func (w *throttleWatcher) read() (int64, time.Duration) {
+	if cgroup.V2() {
+		return readStatValue(w.path, "nr_throttled"), time.Duration(readStatValue(w.path, "throttled_usec")) * time.Microsecond
+	}
+	return readStatValue(w.path, "nr_throttled"), time.Duration(readStatValue(w.path, "throttled_time"))
+}
+
+func (w *throttleWatcher) loop() {
+	defer close(w.done)
+	ticker := time.NewTicker(throttleWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+func (w *throttleWatcher) check() {
+	n, t := w.read()
+	if n < 0 {
+		return
+	}
+	dir := filepath.Dir(w.path)
+	if n > w.last {
+		fmt.Fprintf(os.Stderr, "cgrun: throttled %d times for %s in '%s'\n", n-w.last, t-w.lastTime, dir)
+		w.throttling = true
+	} else if w.throttling {
+		fmt.Fprintf(os.Stderr, "cgrun: no longer throttled in '%s'\n", dir)
+		w.throttling = false
+	}
+	w.last, w.lastTime = n, t
+}
+
+// stop stops watching after reporting throttling since the last check. This
+// has to be called before the cgroup is removed.
+func (w *throttleWatcher) stop() {
+	close(w.quit)
+	<-w.done
+	if n, _ := w.read(); n > w.last {
+		w.check()
+	}
+}